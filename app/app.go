@@ -4,23 +4,56 @@ import (
 	"context"
 	"github.com/gorilla/mux"
 	"github.com/mazanax/go-chat/app/db"
+	"github.com/mazanax/go-chat/app/janitor"
+	"github.com/mazanax/go-chat/app/logger"
 	"github.com/mazanax/go-chat/app/mailer"
+	"github.com/mazanax/go-chat/app/metrics"
 	"github.com/mazanax/go-chat/app/models"
+	"github.com/mazanax/go-chat/app/notifier"
 	"github.com/mazanax/go-chat/app/security"
+	"github.com/mazanax/go-chat/app/storage"
+	"github.com/mazanax/go-chat/app/unfurl"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Config struct {
+	// public URL of the chat, used in links sent to users
+	PublicHost string
+	// audit events record the client address behind these proxies
+	TrustedProxies security.TrustedProxies
+
 	RedisAddr     string
 	RedisPassword string
 	RedisDB       int
 
-	MailerLogin    string
-	MailerSender   string
-	MailerPassword string
-	MailerSmtpHost string
-	MailerSmtpPort int
+	Mailer            mailer.Config
+	MailTemplatesDir  string
+	MailDefaultLocale string
+
+	// see notifier.Config
+	DigestWindow time.Duration
+	Secret       string
+
+	Retention         models.RetentionPolicy
+	RetentionInterval time.Duration
+
+	UploadsDir         string
+	UploadMaxSize      int
+	UploadAllowedTypes []string
+	ThumbnailSize      int
 
 	BCryptCost int
+
+	// usernames allowed to use /api/admin endpoints
+	AdminUsers []string
+	// "memory" keeps the audit trail in process, anything else stores it in Redis
+	AuditStorage string
+
+	// link previews are not fetched unless enabled
+	UnfurlEnabled bool
+	Unfurl        unfurl.Config
 }
 
 type App struct {
@@ -30,26 +63,79 @@ type App struct {
 	TicketRepository             db.TicketRepository
 	OnlineRepository             db.OnlineRepository
 	MessageRepository            db.MessageRepository
+	SearchRepository             db.SearchRepository
+	RetentionRepository          db.RetentionRepository
+	UploadRepository             db.UploadRepository
+	EventRepository              db.EventRepository
+	LinkPreviewRepository        db.LinkPreviewRepository
+	TopicRepository              db.TopicRepository
 	PasswordResetTokenRepository db.ResetPasswordTokenRepository
+	AuditRepository              db.AuditRepository
+	HealthRepository             db.HealthRepository
+	MailOutboxRepository         db.MailOutboxRepository
+	NotificationRepository       db.NotificationRepository
 
 	Router            *mux.Router
 	Mailer            *mailer.Mailer
+	Notifier          *notifier.Notifier
+	Janitor           *janitor.Janitor
+	Unfurler          *unfurl.Unfurler // nil unless link previews are enabled
 	passwordEncryptor security.PasswordEncryptor
+	blobStore         storage.BlobStore
+
+	uploadMaxSize      int
+	uploadAllowedTypes map[string]bool
+	thumbnailSize      int
 
 	notifications chan *models.Message
+	adminUsers    map[string]bool
+	publicHost    string
+	// see Config.TrustedProxies
+	trustedProxies security.TrustedProxies
+
+	readinessMu     sync.Mutex
+	readinessChecks map[string]ReadinessCheck
 }
 
 func New(config Config, notifications chan *models.Message) *App {
 	ctx := context.Background()
 	redisDriver := db.NewRedisDriver(ctx, config.RedisAddr, config.RedisPassword, config.RedisDB)
 	bcryptEncryptor := security.NewBcryptEncryptor(config.BCryptCost)
-	mailer_ := mailer.New(
-		config.MailerLogin,
-		config.MailerSender,
-		config.MailerPassword,
-		config.MailerSmtpHost,
-		config.MailerSmtpPort,
-	)
+	transport, err := mailer.NewTransport(config.Mailer.Transport)
+	if err != nil {
+		logger.Fatal("[app] Cannot create mail transport: %s\n", err)
+	}
+	templates, err := mailer.LoadTemplates(config.MailTemplatesDir, config.MailDefaultLocale, mailer.Brand{
+		Name: config.Mailer.FromName,
+		URL:  config.PublicHost,
+	})
+	if err != nil {
+		logger.Fatal("[app] Cannot load mail templates: %s\n", err)
+	}
+	mailer_ := mailer.New(config.Mailer, transport, templates, &redisDriver)
+
+	blobStore, err := storage.NewLocalBlobStore(config.UploadsDir)
+	if err != nil {
+		logger.Fatal("[app] Cannot create blob store: %s\n", err)
+	}
+
+	uploadAllowedTypes := make(map[string]bool)
+	for _, contentType := range config.UploadAllowedTypes {
+		uploadAllowedTypes[strings.ToLower(strings.TrimSpace(contentType))] = true
+	}
+
+	var auditRepository db.AuditRepository = &redisDriver
+	if config.AuditStorage == "memory" {
+		auditRepository = db.NewMemoryAuditRepository()
+	}
+
+	adminUsers := make(map[string]bool)
+	for _, username := range config.AdminUsers {
+		username = strings.ToLower(strings.TrimSpace(username))
+		if len(username) > 0 {
+			adminUsers[username] = true
+		}
+	}
 
 	app := &App{
 		ctx:                          ctx,
@@ -58,12 +144,50 @@ func New(config Config, notifications chan *models.Message) *App {
 		TicketRepository:             &redisDriver,
 		OnlineRepository:             &redisDriver,
 		MessageRepository:            &redisDriver,
+		SearchRepository:             &redisDriver,
+		RetentionRepository:          &redisDriver,
+		UploadRepository:             &redisDriver,
+		EventRepository:              &redisDriver,
+		LinkPreviewRepository:        &redisDriver,
+		TopicRepository:              &redisDriver,
 		PasswordResetTokenRepository: &redisDriver,
+		AuditRepository:              auditRepository,
+		HealthRepository:             &redisDriver,
+		MailOutboxRepository:         &redisDriver,
+		NotificationRepository:       &redisDriver,
 
 		Router:            mux.NewRouter(),
 		Mailer:            &mailer_,
 		passwordEncryptor: &bcryptEncryptor,
-		notifications:     notifications,
+		blobStore:         blobStore,
+
+		uploadMaxSize:      config.UploadMaxSize,
+		uploadAllowedTypes: uploadAllowedTypes,
+		thumbnailSize:      config.ThumbnailSize,
+
+		notifications:   notifications,
+		adminUsers:      adminUsers,
+		publicHost:      config.PublicHost,
+		trustedProxies:  config.TrustedProxies,
+		readinessChecks: make(map[string]ReadinessCheck),
+	}
+	app.AddReadinessCheck("redis", app.HealthRepository.Ping)
+	app.Notifier = notifier.New(notifier.Config{
+		DigestWindow: config.DigestWindow,
+		Secret:       config.Secret,
+		PublicHost:   config.PublicHost,
+		Locale:       config.MailDefaultLocale,
+	}, app.UserRepository, app.OnlineRepository, app.NotificationRepository, app.Mailer)
+	app.Janitor = janitor.New(janitor.Config{
+		Policy:   config.Retention,
+		Interval: config.RetentionInterval,
+	}, app.RetentionRepository)
+	app.AddReadinessCheck("mailer", app.Mailer.Ping)
+	app.AddReadinessCheck("notifier", app.Notifier.Ping)
+	app.AddReadinessCheck("janitor", app.Janitor.Ping)
+	if config.UnfurlEnabled {
+		app.Unfurler = unfurl.New(config.Unfurl, app.LinkPreviewRepository, notifications)
+		app.AddReadinessCheck("unfurl", app.Unfurler.Ping)
 	}
 
 	app.initRoutes()
@@ -71,15 +195,33 @@ func New(config Config, notifications chan *models.Message) *App {
 }
 
 func (app *App) initRoutes() {
+	app.Router.Use(requestIDMiddleware, metricsMiddleware)
+
 	app.Router.HandleFunc("/api/token", app.TokenHandler()).Methods("POST")
 	app.Router.HandleFunc("/api/user", app.UserHandler()).Methods("GET", "PATCH")
+	app.Router.HandleFunc("/api/user/notifications", app.NotificationPreferencesHandler()).Methods("GET", "PATCH")
+	app.Router.HandleFunc("/api/user/avatar", app.AvatarHandler()).Methods("POST", "DELETE")
 	app.Router.HandleFunc("/api/user/{uuid}", app.UserHandler()).Methods("GET")
+	app.Router.HandleFunc("/api/avatars/{uuid}/{size:[0-9]+}", app.AvatarImageHandler()).Methods("GET")
 	app.Router.HandleFunc("/api/users", app.UsersHandler()).Methods("GET")
 	app.Router.HandleFunc("/api/online", app.OnlineHandler()).Methods("GET")
 	app.Router.HandleFunc("/api/signup", app.SignUpHandler()).Methods("POST")
 	app.Router.HandleFunc("/api/login", app.LoginHandler()).Methods("POST")
 	app.Router.HandleFunc("/api/logout", app.LogoutHandler()).Methods("POST")
 	app.Router.HandleFunc("/api/reset-password", app.ResetPasswordHandler()).Methods("POST")
+	app.Router.HandleFunc("/api/unsubscribe", app.UnsubscribeHandler()).Methods("GET", "POST")
 	app.Router.HandleFunc("/api/ticket", app.TicketHandler()).Methods("POST")
 	app.Router.HandleFunc("/api/history", app.HistoryHandler()).Methods("GET")
+	app.Router.HandleFunc("/api/search", app.SearchHandler()).Methods("GET")
+	app.Router.HandleFunc("/api/topic", app.TopicHandler()).Methods("GET")
+	app.Router.HandleFunc("/api/uploads", app.UploadHandler()).Methods("POST")
+	app.Router.HandleFunc("/api/uploads/{id}", app.DownloadHandler(false)).Methods("GET")
+	app.Router.HandleFunc("/api/uploads/{id}/thumbnail", app.DownloadHandler(true)).Methods("GET")
+	app.Router.HandleFunc("/api/admin/audit", app.AuditHandler()).Methods("GET")
+	app.Router.HandleFunc("/api/admin/retention", app.RetentionHandler()).Methods("GET", "PUT", "DELETE")
+	app.Router.HandleFunc("/api/admin/mail/dead", app.DeadMailsHandler()).Methods("GET")
+	app.Router.HandleFunc("/api/admin/mail/dead/{id}/requeue", app.RequeueMailHandler()).Methods("POST")
+	app.Router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	app.Router.HandleFunc("/healthz", app.HealthzHandler()).Methods("GET")
+	app.Router.HandleFunc("/readyz", app.ReadyzHandler()).Methods("GET")
 }
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/media"
+	"github.com/mazanax/go-chat/app/models"
+	"github.com/mazanax/go-chat/app/storage"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// avatars are square and stored in every one of these sizes, in pixels
+var avatarSizes = []int{32, 64, 128, 256}
+
+// region AvatarHandlers
+
+// AvatarHandler replaces the avatar of the current user with the image in the "file" part of a multipart
+// form (POST) or removes it (DELETE).
+func (app *App) AvatarHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+		user, err := app.currentUser(r)
+		if err != nil {
+			log.Debug("[http] Unauthorized\n")
+			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		// zero means no avatar
+		version := 0
+		if r.Method == http.MethodPost {
+			var ok bool
+			if version, ok = app.storeAvatar(w, r, user); !ok {
+				return
+			}
+		} else {
+			for _, size := range avatarSizes {
+				if err := app.blobStore.Delete(avatarKey(user.ID, size)); err != nil {
+					log.Error("[http] Cannot delete avatar: %s\n", err)
+				}
+			}
+		}
+
+		for field, value := range map[string]int{"avatarVersion": version, "updatedAt": int(time.Now().Unix())} {
+			if err := app.UserRepository.UpdateUserField(&user, field, strconv.Itoa(value)); err != nil {
+				log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+				sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		app.audit(r, models.AuditProfileUpdated, user.ID, user.ID, map[string]string{"fields": "avatar"})
+		user, _ = app.UserRepository.GetUser(user.ID)
+		app.notifyUserUpdated(user)
+		sendResponse(w, mapUserToJson(user, true), http.StatusOK)
+	}
+}
+
+// AvatarImageHandler serves avatars without authorization, so that they can be used in <img> tags.
+func (app *App) AvatarImageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+		vars := mux.Vars(r)
+		size, _ := strconv.Atoi(vars["size"])
+		if !isAvatarSize(size) {
+			sendResponse(w, models.NotFound, http.StatusNotFound)
+			return
+		}
+
+		content, err := app.blobStore.Open(avatarKey(vars["uuid"], size))
+		switch {
+		case errors.Is(err, storage.BlobNotFound) || errors.Is(err, storage.InvalidBlobKey):
+			sendResponse(w, models.NotFound, http.StatusNotFound)
+			return
+		case err != nil:
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+		defer func() { _ = content.Close() }()
+
+		image, err := ioutil.ReadAll(content)
+		if err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		// avatars are written by the server as JPEG or PNG, sniffing tells which one
+		w.Header().Set("Content-Type", http.DetectContentType(image))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		_, _ = w.Write(image)
+	}
+}
+
+// endregion
+
+// storeAvatar reads the uploaded image and stores it in all avatar sizes. It sends the error response itself.
+func (app *App) storeAvatar(w http.ResponseWriter, r *http.Request, user models.User) (int, bool) {
+	log := logger.FromContext(r.Context())
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(app.uploadMaxSize)+multipartOverhead)
+	part, err := filePart(r)
+	if err != nil {
+		log.Debug("[http] Bad request: %s\n", err)
+		sendResponse(w, models.ErrorResponse{
+			Message: "Multipart form with a file part is required",
+			Code:    http.StatusBadRequest,
+		}, http.StatusBadRequest)
+		return 0, false
+	}
+	defer func() { _ = part.Close() }()
+
+	content, err := ioutil.ReadAll(io.LimitReader(part, int64(app.uploadMaxSize)+1))
+	if err != nil {
+		log.Debug("[http] Cannot read avatar: %s\n", err)
+		sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
+		return 0, false
+	}
+	if len(content) > app.uploadMaxSize {
+		sendResponse(w, models.FileTooLarge, http.StatusRequestEntityTooLarge)
+		return 0, false
+	}
+
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	if !media.IsImage(contentType) {
+		log.Debug("[http] Avatar of type %s\n", contentType)
+		sendResponse(w, models.UnsupportedFileType, http.StatusUnsupportedMediaType)
+		return 0, false
+	}
+
+	if _, err := media.DecodeConfig(bytes.NewReader(content)); err != nil {
+		log.Debug("[http] Cannot decode avatar: %s\n", err)
+		sendResponse(w, models.UnsupportedFileType, http.StatusUnsupportedMediaType)
+		return 0, false
+	}
+	release := media.Acquire()
+	defer release()
+	img, err := media.Decode(bytes.NewReader(content))
+	if err != nil {
+		log.Debug("[http] Cannot decode avatar: %s\n", err)
+		sendResponse(w, models.UnsupportedFileType, http.StatusUnsupportedMediaType)
+		return 0, false
+	}
+
+	for _, size := range avatarSizes {
+		var buf bytes.Buffer
+		if err := media.Encode(&buf, media.Square(img, size), thumbnailContentType(contentType)); err != nil {
+			log.Error("[http] Cannot encode avatar: %s\n", err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return 0, false
+		}
+		if _, err := app.blobStore.Put(avatarKey(user.ID, size), &buf); err != nil {
+			log.Error("[http] Cannot store avatar: %s\n", err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return 0, false
+		}
+	}
+
+	return int(time.Now().Unix()), true
+}
+
+func avatarKey(userID string, size int) string {
+	return fmt.Sprintf("avatar-%s-%d", userID, size)
+}
+
+func isAvatarSize(size int) bool {
+	for _, avatarSize := range avatarSizes {
+		if avatarSize == size {
+			return true
+		}
+	}
+
+	return false
+}
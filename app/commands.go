@@ -0,0 +1,104 @@
+package app
+
+import (
+	"github.com/google/uuid"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/models"
+	"github.com/mazanax/go-chat/app/requests"
+	"github.com/mazanax/go-chat/websocket"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// longest topic in characters
+const maxTopicLength = 250
+
+// Commands returns the slash commands which need the app, main registers them with the hub.
+func (app *App) Commands() []websocket.Command {
+	return []websocket.Command{
+		{
+			Name:        "nick",
+			Usage:       "<name>",
+			Description: "changes your display name",
+			MinArgs:     1,
+			MaxArgs:     -1,
+			Run:         app.nickCommand,
+		},
+		{
+			Name:        "topic",
+			Usage:       "[text]",
+			Description: "sets the topic of the chat, or clears it without text",
+			MaxArgs:     -1,
+			Permission:  app.isAdmin,
+			Run:         app.topicCommand,
+		},
+	}
+}
+
+// nickCommand works like changing the name with PATCH /api/user.
+func (app *App) nickCommand(call *websocket.CommandCall) error {
+	name := call.Input
+	if len(requests.Validate(models.UpdateUserRequest{Name: name})) > 0 {
+		return websocket.CommandFailed("name must be 2 to 255 characters long")
+	}
+
+	user := call.User
+	if err := app.UserRepository.UpdateUserField(&user, "name", name); err != nil {
+		return err
+	}
+	if err := app.UserRepository.UpdateUserField(&user, "updatedAt", strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		return err
+	}
+
+	app.auditCommand(call, models.AuditProfileUpdated, user.ID, map[string]string{"fields": "name"})
+	user, err := app.UserRepository.GetUser(user.ID)
+	if err != nil {
+		return err
+	}
+	app.notifyUserUpdated(user)
+	call.Reply("You are now known as %s", user.Name)
+
+	return nil
+}
+
+// topicCommand sets the topic and tells every client about it with a TopicChanged notification.
+func (app *App) topicCommand(call *websocket.CommandCall) error {
+	if utf8.RuneCountInString(call.Input) > maxTopicLength {
+		return websocket.CommandFailed("topic must be at most %d characters long", maxTopicLength)
+	}
+
+	topic := models.Topic{
+		Text:      call.Input,
+		UserID:    call.User.ID,
+		UpdatedAt: int(time.Now().Unix()),
+	}
+	if err := app.TopicRepository.SetTopic(topic); err != nil {
+		return err
+	}
+
+	app.auditCommand(call, models.AuditTopicChanged, "", map[string]string{"topic": topic.Text})
+	app.notifications <- &models.Message{
+		ID:        uuid.NewString(),
+		UserID:    call.User.ID,
+		Type:      models.TopicChanged,
+		Data:      mapTopicToJson(topic),
+		CreatedAt: topic.UpdatedAt,
+	}
+
+	return nil
+}
+
+// auditCommand works like audit for changes made with commands, which have no request.
+func (app *App) auditCommand(call *websocket.CommandCall, eventType string, targetID string, data map[string]string) {
+	err := app.AuditRepository.AppendAuditEvent(models.AuditEvent{
+		Type:     eventType,
+		ActorID:  call.User.ID,
+		TargetID: targetID,
+		IP:       call.IP,
+		Data:     data,
+	})
+	if err != nil {
+		logger.Error("[audit] Cannot store %s event for %s: %s\n", eventType, call.User.ID, err)
+	}
+}
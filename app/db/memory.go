@@ -0,0 +1,76 @@
+package db
+
+import (
+	"github.com/google/uuid"
+	"github.com/mazanax/go-chat/app/models"
+	"sync"
+	"time"
+)
+
+// MemoryAuditRepository keeps the audit trail in process memory.
+// It is intended for development and single-node setups where losing the trail on restart is acceptable.
+type MemoryAuditRepository struct {
+	mu     sync.RWMutex
+	events []models.AuditEvent
+}
+
+func NewMemoryAuditRepository() *MemoryAuditRepository {
+	return &MemoryAuditRepository{}
+}
+
+func (repo *MemoryAuditRepository) AppendAuditEvent(event models.AuditEvent) error {
+	if len(event.ID) == 0 {
+		event.ID = uuid.NewString()
+	}
+	if event.CreatedAt == 0 {
+		event.CreatedAt = int(time.Now().Unix())
+	}
+
+	data := make(map[string]string, len(event.Data))
+	for key, value := range event.Data {
+		data[key] = value
+	}
+	event.Data = data
+
+	repo.mu.Lock()
+	repo.events = append(repo.events, event)
+	repo.mu.Unlock()
+
+	return nil
+}
+
+func (repo *MemoryAuditRepository) GetAuditEvents(filter AuditFilter) ([]models.AuditEvent, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+
+	var result []models.AuditEvent
+	// newest first, the same order as RedisDriver returns
+	for i := len(repo.events) - 1; i >= 0; i-- {
+		event := repo.events[i]
+		if !matchAuditFilter(event, filter) {
+			continue
+		}
+
+		result = append(result, event)
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func matchAuditFilter(event models.AuditEvent, filter AuditFilter) bool {
+	switch {
+	case len(filter.ActorID) > 0 && event.ActorID != filter.ActorID:
+		return false
+	case len(filter.Type) > 0 && event.Type != filter.Type:
+		return false
+	case filter.From > 0 && event.CreatedAt < filter.From:
+		return false
+	case filter.To > 0 && event.CreatedAt > filter.To:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/mazanax/go-chat/app/metrics"
+	"time"
+)
+
+var redisDuration = metrics.NewHistogramVec(
+	"chat_redis_operation_duration_seconds",
+	"Latency of Redis commands and pipelines issued by RedisDriver.",
+	[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	"operation",
+)
+
+type startTimeKey struct{}
+
+// metricsHook measures every command sent through the Redis connection.
+type metricsHook struct{}
+
+func (metricsHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, startTimeKey{}, time.Now()), nil
+}
+
+func (metricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if start, ok := ctx.Value(startTimeKey{}).(time.Time); ok {
+		redisDuration.WithLabelValues(cmd.Name()).ObserveSince(start)
+	}
+
+	return nil
+}
+
+func (metricsHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, startTimeKey{}, time.Now()), nil
+}
+
+func (metricsHook) AfterProcessPipeline(ctx context.Context, _ []redis.Cmder) error {
+	if start, ok := ctx.Value(startTimeKey{}).(time.Time); ok {
+		redisDuration.WithLabelValues("pipeline").ObserveSince(start)
+	}
+
+	return nil
+}
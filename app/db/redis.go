@@ -2,12 +2,16 @@ package db
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/mazanax/go-chat/app/logger"
 	"github.com/mazanax/go-chat/app/models"
+	"github.com/mazanax/go-chat/app/search"
 	"strconv"
 	"strings"
 	"time"
@@ -19,16 +23,30 @@ type RedisDriver struct {
 }
 
 func NewRedisDriver(ctx context.Context, addr string, password string, defaultDb int) RedisDriver {
+	connection := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       defaultDb,
+	})
+	connection.AddHook(metricsHook{})
+
 	return RedisDriver{
-		ctx: ctx,
-		connection: redis.NewClient(&redis.Options{
-			Addr:     addr,
-			Password: password,
-			DB:       defaultDb,
-		}),
+		ctx:        ctx,
+		connection: connection,
 	}
 }
 
+// region HealthRepository
+
+func (rd *RedisDriver) Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(rd.ctx, timeout)
+	defer cancel()
+
+	return rd.connection.Ping(ctx).Err()
+}
+
+// endregion
+
 // region UserRepository
 
 func (rd *RedisDriver) IsEmailExists(email string) bool {
@@ -124,6 +142,7 @@ func (rd *RedisDriver) GetUser(id string) (models.User, error) {
 
 	createdAt, _ := strconv.Atoi(val["createdAt"])
 	updatedAt, _ := strconv.Atoi(val["updatedAt"])
+	avatarVersion, _ := strconv.Atoi(val["avatarVersion"])
 	return models.User{
 		ID:        val["id"],
 		Email:     val["email"],
@@ -132,6 +151,12 @@ func (rd *RedisDriver) GetUser(id string) (models.User, error) {
 		Password:  val["password"],
 		CreatedAt: createdAt,
 		UpdatedAt: updatedAt,
+
+		Bio:           val["bio"],
+		Status:        val["status"],
+		Timezone:      val["timezone"],
+		Pronouns:      val["pronouns"],
+		AvatarVersion: avatarVersion,
 	}, nil
 }
 
@@ -172,6 +197,18 @@ func (rd *RedisDriver) FindUserByEmail(email string) (models.User, error) {
 	return rd.GetUser(userId)
 }
 
+func (rd *RedisDriver) FindUserByUsername(username string) (models.User, error) {
+	userId, err := rd.connection.HGet(rd.ctx, "usernames", strings.ToLower(username)).Result()
+	switch {
+	case errors.Is(err, redis.Nil) || len(userId) == 0:
+		return models.User{}, UserNotFound
+	case err != nil:
+		logger.Fatal("Redis connection failed: %s", err.Error())
+	}
+
+	return rd.GetUser(userId)
+}
+
 func (rd *RedisDriver) UpdateUserField(user *models.User, field string, value string) error {
 	if _, err := rd.GetUser(user.ID); errors.Is(err, UserNotFound) {
 		return err
@@ -372,6 +409,15 @@ func (rd *RedisDriver) GetOnlineUsers() []string {
 	return users
 }
 
+func (rd *RedisDriver) IsUserOnline(userUUID string) bool {
+	val, err := rd.connection.SIsMember(rd.ctx, "online", userUUID).Result()
+	if err != nil {
+		logger.Fatal("Redis connection failed: %s", err.Error())
+	}
+
+	return val
+}
+
 func (rd *RedisDriver) CreateUserOnline(userUUID string) error {
 	_, err := rd.connection.SAdd(rd.ctx, "online", userUUID).Result()
 	if err != nil {
@@ -394,38 +440,184 @@ func (rd *RedisDriver) RemoveUserOnline(userUUID string) error {
 
 // region MessageRepository
 
-func (rd *RedisDriver) StoreMessage(userID string, messageType int, messageUUID string, text string) (string, error) {
-	_, err := rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
-		_, err := pipe.HSet(
-			rd.ctx,
-			fmt.Sprintf("message:%s", messageUUID),
-			map[string]interface{}{
-				"id":        messageUUID,
-				"userId":    userID,
-				"createdAt": time.Now().Unix(),
-				"type":      messageType,
-				"text":      text,
-			},
-		).Result()
-		if err != nil {
-			_ = pipe.Discard()
+func (rd *RedisDriver) StoreMessage(
+	userID string,
+	messageType int,
+	messageUUID string,
+	text string,
+	mentions []string,
+	attachments []string,
+) (string, error) {
+	key := fmt.Sprintf("message:%s", messageUUID)
+	directKey := fmt.Sprintf("direct_message:%s", messageUUID)
+	createdAt := time.Now().Unix()
+	rendered := models.Message{Text: text}
+	rendered.Render()
+	markup, err := json.Marshal(rendered.Markup)
+	if err != nil {
+		return "", err
+	}
+	store := func(tx *redis.Tx) error {
+		owner, err := tx.HGet(rd.ctx, key, "userId").Result()
+		switch {
+		case err == nil && owner == userID:
+			return MessageAlreadyStored
+		case err == nil:
+			return MessageIDTaken
+		case !errors.Is(err, redis.Nil):
 			return err
 		}
+		if direct, err := tx.Exists(rd.ctx, directKey).Result(); err != nil {
+			return err
+		} else if direct > 0 {
+			return MessageIDTaken
+		}
 
-		_, err = pipe.LPush(rd.ctx, "messages", messageUUID).Result()
-		if err != nil {
-			_ = pipe.Discard()
+		_, err = tx.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+			_, err := pipe.HSet(
+				rd.ctx,
+				key,
+				map[string]interface{}{
+					"id":          messageUUID,
+					"userId":      userID,
+					"createdAt":   createdAt,
+					"type":        messageType,
+					"text":        text,
+					"html":        rendered.HTML,
+					"markup":      markup,
+					"mentions":    strings.Join(mentions, ","),
+					"attachments": strings.Join(attachments, ","),
+				},
+			).Result()
+			if err != nil {
+				_ = pipe.Discard()
+				return err
+			}
+
+			_, err = pipe.LPush(rd.ctx, "messages", messageUUID).Result()
+			if err != nil {
+				_ = pipe.Discard()
+				return err
+			}
+
+			// the index is written in the same transaction, so a stored message is always searchable
+			for _, indexKey := range searchKeys(userID, text) {
+				_, err = pipe.ZAdd(rd.ctx, indexKey, &redis.Z{Score: float64(createdAt), Member: messageUUID}).Result()
+				if err != nil {
+					_ = pipe.Discard()
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		return err
+	}
+
+	// a concurrent submission of the same ID fails the transaction, the retry finds the stored message
+	for attempt := 0; attempt < 2; attempt++ {
+		err := rd.connection.Watch(rd.ctx, store, key, directKey)
+		switch {
+		case errors.Is(err, redis.TxFailedErr):
+			continue
+		case errors.Is(err, MessageAlreadyStored):
+			return messageUUID, err
+		case err != nil:
+			return "", err
+		}
+
+		return messageUUID, nil
+	}
+
+	return "", redis.TxFailedErr
+}
+
+// directMessageRecord is what is kept of a direct message, to answer retries.
+type directMessageRecord struct {
+	Message     models.Message
+	RecipientID string
+}
+
+func (rd *RedisDriver) StoreDirectMessage(message models.Message, recipientID string, ttl time.Duration) (models.Message, error) {
+	key := fmt.Sprintf("direct_message:%s", message.ID)
+	messageKey := fmt.Sprintf("message:%s", message.ID)
+	encoded, err := json.Marshal(directMessageRecord{Message: message, RecipientID: recipientID})
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	var kept models.Message
+	store := func(tx *redis.Tx) error {
+		if stored, err := tx.Exists(rd.ctx, messageKey).Result(); err != nil {
 			return err
+		} else if stored > 0 {
+			return MessageIDTaken
 		}
 
+		existing, err := tx.Get(rd.ctx, key).Result()
+		switch {
+		case err == nil:
+			var record directMessageRecord
+			if err := json.Unmarshal([]byte(existing), &record); err != nil {
+				return err
+			}
+			if record.Message.UserID != message.UserID {
+				return MessageIDTaken
+			}
+			kept = record.Message
+			return MessageAlreadyStored
+		case !errors.Is(err, redis.Nil):
+			return err
+		}
+
+		_, err = tx.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(rd.ctx, key, encoded, ttl)
+			return nil
+		})
+
+		return err
+	}
+
+	// like StoreMessage, a concurrent retry fails the transaction and finds the message on the next attempt
+	for attempt := 0; attempt < 2; attempt++ {
+		err := rd.connection.Watch(rd.ctx, store, key, messageKey)
+		switch {
+		case errors.Is(err, redis.TxFailedErr):
+			continue
+		case errors.Is(err, MessageAlreadyStored):
+			return kept, err
+		case err != nil:
+			return models.Message{}, err
+		}
+
+		return message, nil
+	}
+
+	return models.Message{}, redis.TxFailedErr
+}
+
+// unlinkMessage deletes the hash of the message and its search index entries, but not its place in the list.
+func (rd *RedisDriver) unlinkMessage(pipe redis.Pipeliner, message models.Message) {
+	pipe.Del(rd.ctx, fmt.Sprintf("message:%s", message.ID))
+	for _, key := range searchKeys(message.UserID, message.Text) {
+		pipe.ZRem(rd.ctx, key, message.ID)
+	}
+}
+
+// searchKeys returns the index sets of the message: one per term and, if it has any, one of the author.
+func searchKeys(userID string, text string) []string {
+	terms := search.Tokenize(text)
+	if len(terms) == 0 {
 		return nil
-	})
+	}
 
-	if err != nil {
-		return "", err
+	keys := make([]string, 0, len(terms)+1)
+	for _, term := range terms {
+		keys = append(keys, fmt.Sprintf("search_term:%s", term))
 	}
 
-	return messageUUID, nil
+	return append(keys, fmt.Sprintf("search_author:%s", userID))
 }
 
 func (rd *RedisDriver) GetMessage(messageUUID string) (models.Message, error) {
@@ -439,13 +631,52 @@ func (rd *RedisDriver) GetMessage(messageUUID string) (models.Message, error) {
 
 	createdAt, _ := strconv.Atoi(val["createdAt"])
 	messageType, _ := strconv.Atoi(val["type"])
-	return models.Message{
-		ID:        val["id"],
-		UserID:    val["userId"],
-		CreatedAt: createdAt,
-		Type:      messageType,
-		Text:      val["text"],
-	}, nil
+	var mentions []string
+	if len(val["mentions"]) > 0 {
+		mentions = strings.Split(val["mentions"], ",")
+	}
+	var attachments []models.Upload
+	if len(val["attachments"]) > 0 {
+		for _, uploadID := range strings.Split(val["attachments"], ",") {
+			upload, err := rd.GetUpload(uploadID)
+			if err != nil {
+				logger.Error("[GetMessage] Cannot get attachment %s of message %s: %s\n", uploadID, messageUUID, err)
+				continue
+			}
+			attachments = append(attachments, upload)
+		}
+	}
+	var previews []models.LinkPreview
+	if len(val["previews"]) > 0 {
+		if err := json.Unmarshal([]byte(val["previews"]), &previews); err != nil {
+			logger.Error("[GetMessage] Cannot decode link previews of message %s: %s\n", messageUUID, err)
+		}
+	}
+
+	message := models.Message{
+		ID:          val["id"],
+		UserID:      val["userId"],
+		CreatedAt:   createdAt,
+		Type:        messageType,
+		Text:        val["text"],
+		HTML:        val["html"],
+		Mentions:    mentions,
+		Attachments: attachments,
+		Previews:    previews,
+	}
+	_, rendered := val["html"]
+	if rendered {
+		if err := json.Unmarshal([]byte(val["markup"]), &message.Markup); err != nil {
+			logger.Error("[GetMessage] Cannot decode markup of message %s: %s\n", messageUUID, err)
+			rendered = false
+		}
+	}
+	// messages stored before they were rendered on the way in
+	if !rendered {
+		message.Render()
+	}
+
+	return message, nil
 }
 
 func (rd *RedisDriver) GetMessages(limit int) []models.Message {
@@ -592,3 +823,835 @@ func (rd *RedisDriver) RemoveResetPasswordToken(token models.PasswordResetToken)
 }
 
 // endregion
+
+// region AuditRepository
+
+func (rd *RedisDriver) AppendAuditEvent(event models.AuditEvent) error {
+	if len(event.ID) == 0 {
+		event.ID = uuid.NewString()
+	}
+	if event.CreatedAt == 0 {
+		event.CreatedAt = int(time.Now().Unix())
+	}
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+		_, err := pipe.HSet(
+			rd.ctx,
+			fmt.Sprintf("audit:%s", event.ID),
+			map[string]interface{}{
+				"id":        event.ID,
+				"type":      event.Type,
+				"actorId":   event.ActorID,
+				"targetId":  event.TargetID,
+				"ip":        event.IP,
+				"createdAt": event.CreatedAt,
+				"data":      string(data),
+			},
+		).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		member := &redis.Z{Score: float64(event.CreatedAt), Member: event.ID}
+		keys := []string{"audit", fmt.Sprintf("audit_type:%s", event.Type)}
+		if len(event.ActorID) > 0 {
+			keys = append(keys, fmt.Sprintf("audit_actor:%s", event.ActorID))
+		}
+		for _, key := range keys {
+			_, err = pipe.ZAdd(rd.ctx, key, member).Result()
+			if err != nil {
+				_ = pipe.Discard()
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return AuditEventNotCreated
+	}
+
+	return nil
+}
+
+func (rd *RedisDriver) GetAuditEvents(filter AuditFilter) ([]models.AuditEvent, error) {
+	// the most selective index is used for the scan, the rest of the filter is applied in place
+	key := "audit"
+	switch {
+	case len(filter.ActorID) > 0:
+		key = fmt.Sprintf("audit_actor:%s", filter.ActorID)
+	case len(filter.Type) > 0:
+		key = fmt.Sprintf("audit_type:%s", filter.Type)
+	}
+
+	min, max := "-inf", "+inf"
+	if filter.From > 0 {
+		min = strconv.Itoa(filter.From)
+	}
+	if filter.To > 0 {
+		max = strconv.Itoa(filter.To)
+	}
+
+	const pageSize = 100
+	var result []models.AuditEvent
+	for offset := int64(0); ; offset += pageSize {
+		ids, err := rd.connection.ZRevRangeByScore(rd.ctx, key, &redis.ZRangeBy{
+			Min:    min,
+			Max:    max,
+			Offset: offset,
+			Count:  pageSize,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			event, err := rd.getAuditEvent(id)
+			if err != nil {
+				logger.Error("[GetAuditEvents] Cannot get audit event #%s %s\n", id, err)
+				continue
+			}
+			if !matchAuditFilter(event, filter) {
+				continue
+			}
+
+			result = append(result, event)
+			if filter.Limit > 0 && len(result) >= filter.Limit {
+				return result, nil
+			}
+		}
+
+		if len(ids) < pageSize {
+			return result, nil
+		}
+	}
+}
+
+func (rd *RedisDriver) getAuditEvent(id string) (models.AuditEvent, error) {
+	val, err := rd.connection.HGetAll(rd.ctx, fmt.Sprintf("audit:%s", id)).Result()
+	switch {
+	case errors.Is(err, redis.Nil) || len(val) == 0:
+		return models.AuditEvent{}, fmt.Errorf("audit event %s not found", id)
+	case err != nil:
+		return models.AuditEvent{}, err
+	}
+
+	var data map[string]string
+	_ = json.Unmarshal([]byte(val["data"]), &data)
+	createdAt, _ := strconv.Atoi(val["createdAt"])
+	return models.AuditEvent{
+		ID:        val["id"],
+		Type:      val["type"],
+		ActorID:   val["actorId"],
+		TargetID:  val["targetId"],
+		IP:        val["ip"],
+		CreatedAt: createdAt,
+		Data:      data,
+	}, nil
+}
+
+// endregion
+
+// region MailOutboxRepository
+
+// claimMailsScript moves the score of due mails into the future atomically, so that several nodes never
+// claim the same mail.
+var claimMailsScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, id in ipairs(ids) do
+	redis.call('ZADD', KEYS[1], ARGV[2], id)
+end
+return ids
+`)
+
+func (rd *RedisDriver) EnqueueMail(mail models.Mail) error {
+	_, err := rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+		_, err := pipe.HSet(rd.ctx, fmt.Sprintf("mail:%s", mail.ID), mailToHash(mail)).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		_, err = pipe.ZAdd(rd.ctx, "mail_outbox", &redis.Z{Score: float64(mail.NextAttemptAt), Member: mail.ID}).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (rd *RedisDriver) ClaimDueMails(limit int, lease time.Duration) ([]models.Mail, error) {
+	now := time.Now()
+	reply, err := claimMailsScript.Run(
+		rd.ctx,
+		rd.connection,
+		[]string{"mail_outbox"},
+		now.Unix(),
+		now.Add(lease).Unix(),
+		limit,
+	).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	ids, _ := reply.([]interface{})
+	var result []models.Mail
+	for _, item := range ids {
+		id, _ := item.(string)
+		mail, err := rd.getMail(id)
+		if errors.Is(err, MailNotFound) {
+			logger.Error("[ClaimDueMails] Mail #%s is queued but not stored, dropping it\n", id)
+			_, _ = rd.connection.ZRem(rd.ctx, "mail_outbox", id).Result()
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+
+		result = append(result, mail)
+	}
+
+	return result, nil
+}
+
+func (rd *RedisDriver) MarkMailSent(mail models.Mail) error {
+	_, err := rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+		_, err := pipe.ZRem(rd.ctx, "mail_outbox", mail.ID).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		_, err = pipe.Del(rd.ctx, fmt.Sprintf("mail:%s", mail.ID)).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (rd *RedisDriver) RetryMail(mail models.Mail, nextAttemptAt time.Time) error {
+	mail.NextAttemptAt = int(nextAttemptAt.Unix())
+
+	return rd.EnqueueMail(mail)
+}
+
+func (rd *RedisDriver) DeadLetterMail(mail models.Mail) error {
+	mail.NextAttemptAt = int(time.Now().Unix())
+
+	_, err := rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+		_, err := pipe.HSet(rd.ctx, fmt.Sprintf("mail:%s", mail.ID), mailToHash(mail)).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		_, err = pipe.ZRem(rd.ctx, "mail_outbox", mail.ID).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		_, err = pipe.ZAdd(rd.ctx, "mail_dead", &redis.Z{Score: float64(mail.NextAttemptAt), Member: mail.ID}).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (rd *RedisDriver) GetDeadMails(limit int) ([]models.Mail, error) {
+	ids, err := rd.connection.ZRevRange(rd.ctx, "mail_dead", 0, int64(limit)-1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	var result []models.Mail
+	for _, id := range ids {
+		mail, err := rd.getMail(id)
+		if err != nil {
+			logger.Error("[GetDeadMails] Cannot get mail #%s %s\n", id, err)
+			continue
+		}
+
+		result = append(result, mail)
+	}
+
+	return result, nil
+}
+
+func (rd *RedisDriver) RequeueDeadMail(id string) error {
+	removed, err := rd.connection.ZRem(rd.ctx, "mail_dead", id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return MailNotFound
+	}
+
+	mail, err := rd.getMail(id)
+	if err != nil {
+		return err
+	}
+
+	mail.Attempts = 0
+	mail.NextAttemptAt = int(time.Now().Unix())
+	return rd.EnqueueMail(mail)
+}
+
+func (rd *RedisDriver) OutboxSize() (int, error) {
+	size, err := rd.connection.ZCard(rd.ctx, "mail_outbox").Result()
+	return int(size), err
+}
+
+func (rd *RedisDriver) getMail(id string) (models.Mail, error) {
+	val, err := rd.connection.HGetAll(rd.ctx, fmt.Sprintf("mail:%s", id)).Result()
+	switch {
+	case errors.Is(err, redis.Nil) || len(val) == 0:
+		return models.Mail{}, MailNotFound
+	case err != nil:
+		return models.Mail{}, err
+	}
+
+	attempts, _ := strconv.Atoi(val["attempts"])
+	createdAt, _ := strconv.Atoi(val["createdAt"])
+	nextAttemptAt, _ := strconv.Atoi(val["nextAttemptAt"])
+	return models.Mail{
+		ID:            val["id"],
+		To:            val["to"],
+		Subject:       val["subject"],
+		Message:       val["message"],
+		Attempts:      attempts,
+		LastError:     val["lastError"],
+		CreatedAt:     createdAt,
+		NextAttemptAt: nextAttemptAt,
+	}, nil
+}
+
+func mailToHash(mail models.Mail) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            mail.ID,
+		"to":            mail.To,
+		"subject":       mail.Subject,
+		"message":       mail.Message,
+		"attempts":      mail.Attempts,
+		"lastError":     mail.LastError,
+		"createdAt":     mail.CreatedAt,
+		"nextAttemptAt": mail.NextAttemptAt,
+	}
+}
+
+// endregion
+
+// region NotificationRepository
+
+// claimDigestsScript pops due users from the schedule atomically, so that several nodes never send the same digest.
+var claimDigestsScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+end
+return ids
+`)
+
+func (rd *RedisDriver) GetNotificationPreferences(userID string) (models.NotificationPreferences, error) {
+	val, err := rd.connection.HGetAll(rd.ctx, fmt.Sprintf("notification_prefs:%s", userID)).Result()
+	switch {
+	case errors.Is(err, redis.Nil) || len(val) == 0:
+		return models.DefaultNotificationPreferences, nil
+	case err != nil:
+		return models.NotificationPreferences{}, err
+	}
+
+	mentions, _ := strconv.ParseBool(val["mentions"])
+	directMessages, _ := strconv.ParseBool(val["directMessages"])
+	return models.NotificationPreferences{
+		Mentions:       mentions,
+		DirectMessages: directMessages,
+	}, nil
+}
+
+func (rd *RedisDriver) SetNotificationPreferences(userID string, preferences models.NotificationPreferences) error {
+	_, err := rd.connection.HSet(
+		rd.ctx,
+		fmt.Sprintf("notification_prefs:%s", userID),
+		map[string]interface{}{
+			"mentions":       strconv.FormatBool(preferences.Mentions),
+			"directMessages": strconv.FormatBool(preferences.DirectMessages),
+		},
+	).Result()
+
+	return err
+}
+
+func (rd *RedisDriver) AddDigestItem(userID string, item models.DigestItem, dueAt time.Time) error {
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	_, err = rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+		_, err := pipe.RPush(rd.ctx, fmt.Sprintf("digest:%s", userID), encoded).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		// NX keeps the due time of the first pending item, so a busy chat does not postpone the digest forever
+		_, err = pipe.ZAddNX(rd.ctx, "digest_due", &redis.Z{Score: float64(dueAt.Unix()), Member: userID}).Result()
+		if err != nil {
+			_ = pipe.Discard()
+			return err
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (rd *RedisDriver) ClaimDueDigests(limit int) ([]string, error) {
+	reply, err := claimDigestsScript.Run(rd.ctx, rd.connection, []string{"digest_due"}, time.Now().Unix(), limit).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	items, _ := reply.([]interface{})
+	userIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		if userID, ok := item.(string); ok {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	return userIDs, nil
+}
+
+func (rd *RedisDriver) ScheduleDigest(userID string, dueAt time.Time) error {
+	_, err := rd.connection.ZAddNX(rd.ctx, "digest_due", &redis.Z{Score: float64(dueAt.Unix()), Member: userID}).Result()
+
+	return err
+}
+
+func (rd *RedisDriver) GetDigestItems(userID string) ([]models.DigestItem, error) {
+	encodedItems, err := rd.connection.LRange(rd.ctx, fmt.Sprintf("digest:%s", userID), 0, -1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	items := make([]models.DigestItem, len(encodedItems))
+	for i, encoded := range encodedItems {
+		if err := json.Unmarshal([]byte(encoded), &items[i]); err != nil {
+			logger.Error("[GetDigestItems] Cannot decode digest item of #%s: %s\n", userID, err)
+			items[i] = models.DigestItem{}
+		}
+	}
+
+	return items, nil
+}
+
+func (rd *RedisDriver) RemoveDigestItems(userID string, count int) error {
+	if count == 0 {
+		return nil
+	}
+
+	_, err := rd.connection.LTrim(rd.ctx, fmt.Sprintf("digest:%s", userID), int64(count), -1).Result()
+
+	return err
+}
+
+// endregion
+
+// region SearchRepository
+
+func (rd *RedisDriver) SearchMessages(query SearchQuery) ([]models.Message, int, error) {
+	if len(query.Terms) == 0 {
+		return nil, 0, nil
+	}
+
+	keys := make([]string, 0, len(query.Terms)+1)
+	for _, term := range query.Terms {
+		keys = append(keys, fmt.Sprintf("search_term:%s", term))
+	}
+	if len(query.AuthorID) > 0 {
+		keys = append(keys, fmt.Sprintf("search_author:%s", query.AuthorID))
+	}
+
+	min, max := "-inf", "+inf"
+	if query.From > 0 {
+		min = strconv.Itoa(query.From)
+	}
+	if query.To > 0 {
+		max = strconv.Itoa(query.To)
+	}
+
+	// every set is scored by the creation time, so the intersection is too
+	result := fmt.Sprintf("search_result:%s", uuid.NewString())
+	var ids *redis.StringSliceCmd
+	var total *redis.IntCmd
+	_, err := rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZInterStore(rd.ctx, result, &redis.ZStore{Keys: keys, Aggregate: "MAX"})
+		ids = pipe.ZRevRangeByScore(rd.ctx, result, &redis.ZRangeBy{
+			Min:    min,
+			Max:    max,
+			Offset: int64(query.Offset),
+			Count:  int64(query.Limit),
+		})
+		total = pipe.ZCount(rd.ctx, result, min, max)
+		pipe.Del(rd.ctx, result)
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	messages := make([]models.Message, 0, len(ids.Val()))
+	for _, id := range ids.Val() {
+		message, err := rd.GetMessage(id)
+		if err != nil {
+			logger.Error("[SearchMessages] Cannot get message %s: %s\n", id, err)
+			continue
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, int(total.Val()), nil
+}
+
+// endregion
+
+// region RetentionRepository
+
+func (rd *RedisDriver) GetRetentionPolicy() (models.RetentionPolicy, bool, error) {
+	val, err := rd.connection.HGetAll(rd.ctx, "retention").Result()
+	switch {
+	case errors.Is(err, redis.Nil) || len(val) == 0:
+		return models.RetentionPolicy{}, false, nil
+	case err != nil:
+		return models.RetentionPolicy{}, false, err
+	}
+
+	maxAge, _ := strconv.Atoi(val["maxAge"])
+	maxCount, _ := strconv.Atoi(val["maxCount"])
+	return models.RetentionPolicy{
+		MaxAge:   time.Duration(maxAge) * time.Second,
+		MaxCount: maxCount,
+	}, true, nil
+}
+
+func (rd *RedisDriver) SetRetentionPolicy(policy models.RetentionPolicy) error {
+	_, err := rd.connection.HSet(
+		rd.ctx,
+		"retention",
+		map[string]interface{}{
+			"maxAge":   int(policy.MaxAge / time.Second),
+			"maxCount": policy.MaxCount,
+		},
+	).Result()
+
+	return err
+}
+
+func (rd *RedisDriver) ResetRetentionPolicy() error {
+	return rd.connection.Del(rd.ctx, "retention").Err()
+}
+
+func (rd *RedisDriver) PruneMessages(maxCount int, createdBefore int, limit int) (int, error) {
+	length, err := rd.connection.LLen(rd.ctx, "messages").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// new messages are pushed to the head, so the oldest ones are at the tail
+	ids, err := rd.connection.LRange(rd.ctx, "messages", int64(-limit), -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	excess := 0
+	if maxCount > 0 && int(length) > maxCount {
+		excess = int(length) - maxCount
+	}
+
+	var expired []models.Message
+	for i := len(ids) - 1; i >= 0; i-- {
+		message, err := rd.GetMessage(ids[i])
+		if err != nil && !errors.Is(err, MessageNotFound) {
+			return 0, err
+		}
+		// a message without hash has nothing to keep
+		message.ID = ids[i]
+
+		if len(expired) >= excess && (createdBefore == 0 || (err == nil && message.CreatedAt >= createdBefore)) {
+			break
+		}
+		expired = append(expired, message)
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	_, err = rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+		for _, message := range expired {
+			rd.unlinkMessage(pipe, message)
+		}
+		// negative indexes keep the trim right even if messages were pushed to the head meanwhile
+		pipe.LTrim(rd.ctx, "messages", 0, int64(-len(expired)-1))
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(expired), nil
+}
+
+// endregion
+
+// region UploadRepository
+
+func (rd *RedisDriver) CreateUpload(upload models.Upload) error {
+	_, err := rd.connection.HSet(
+		rd.ctx,
+		fmt.Sprintf("upload:%s", upload.ID),
+		map[string]interface{}{
+			"id":           upload.ID,
+			"userId":       upload.UserID,
+			"name":         upload.Name,
+			"contentType":  upload.ContentType,
+			"size":         upload.Size,
+			"width":        upload.Width,
+			"height":       upload.Height,
+			"hasThumbnail": strconv.FormatBool(upload.HasThumbnail),
+			"createdAt":    upload.CreatedAt,
+		},
+	).Result()
+
+	return err
+}
+
+func (rd *RedisDriver) GetUpload(id string) (models.Upload, error) {
+	val, err := rd.connection.HGetAll(rd.ctx, fmt.Sprintf("upload:%s", id)).Result()
+	switch {
+	case errors.Is(err, redis.Nil) || len(val) == 0:
+		return models.Upload{}, UploadNotFound
+	case err != nil:
+		return models.Upload{}, err
+	}
+
+	size, _ := strconv.Atoi(val["size"])
+	width, _ := strconv.Atoi(val["width"])
+	height, _ := strconv.Atoi(val["height"])
+	hasThumbnail, _ := strconv.ParseBool(val["hasThumbnail"])
+	createdAt, _ := strconv.Atoi(val["createdAt"])
+	return models.Upload{
+		ID:           val["id"],
+		UserID:       val["userId"],
+		Name:         val["name"],
+		ContentType:  val["contentType"],
+		Size:         size,
+		Width:        width,
+		Height:       height,
+		HasThumbnail: hasThumbnail,
+		CreatedAt:    createdAt,
+	}, nil
+}
+
+// endregion
+
+// region EventRepository
+
+// appendEventScript numbers and stores the event atomically, so that sequence numbers of several nodes never
+// clash and the buffer never holds more than the limit.
+var appendEventScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+redis.call('ZADD', KEYS[2], seq, seq .. ':' .. ARGV[1])
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -tonumber(ARGV[2]) - 1)
+return seq
+`)
+
+func (rd *RedisDriver) AppendEvent(event models.HubEvent, limit int) (int64, error) {
+	event.Seq = 0
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+
+	return appendEventScript.Run(rd.ctx, rd.connection, []string{"event_seq", "events"}, encoded, limit).Int64()
+}
+
+func (rd *RedisDriver) GetEventsSince(seq int64, limit int) ([]models.HubEvent, bool, error) {
+	var last *redis.StringCmd
+	var oldest *redis.ZSliceCmd
+	var newer *redis.StringSliceCmd
+	_, err := rd.connection.TxPipelined(rd.ctx, func(pipe redis.Pipeliner) error {
+		last = pipe.Get(rd.ctx, "event_seq")
+		oldest = pipe.ZRangeWithScores(rd.ctx, "events", 0, 0)
+		// one more than requested tells whether the replay is complete
+		newer = pipe.ZRangeByScore(rd.ctx, "events", &redis.ZRangeBy{
+			Min:   fmt.Sprintf("(%d", seq),
+			Max:   "+inf",
+			Count: int64(limit) + 1,
+		})
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, false, err
+	}
+
+	lastSeq, _ := strconv.ParseInt(last.Val(), 10, 64)
+	if seq > lastSeq {
+		return nil, false, nil
+	}
+	if seq == lastSeq {
+		return []models.HubEvent{}, true, nil
+	}
+	if len(oldest.Val()) == 0 || int64(oldest.Val()[0].Score) > seq+1 || len(newer.Val()) > limit {
+		return nil, false, nil
+	}
+
+	events := make([]models.HubEvent, 0, len(newer.Val()))
+	for _, member := range newer.Val() {
+		separator := strings.IndexByte(member, ':')
+		if separator < 0 {
+			return nil, false, fmt.Errorf("malformed event %q", member)
+		}
+
+		var event models.HubEvent
+		if err := json.Unmarshal([]byte(member[separator+1:]), &event); err != nil {
+			return nil, false, err
+		}
+		event.Seq, _ = strconv.ParseInt(member[:separator], 10, 64)
+		event.Message.Seq = event.Seq
+		// buffered before messages were rendered on the way in
+		if len(event.Message.Text) > 0 && event.Message.Markup == nil {
+			event.Message.Render()
+		}
+		events = append(events, event)
+	}
+
+	return events, true, nil
+}
+
+// endregion
+
+// region LinkPreviewRepository
+
+// setMessagePreviewsScript does not recreate a message deleted while its links were fetched.
+var setMessagePreviewsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'previews', ARGV[1])
+return 1
+`)
+
+// previews are keyed by a hash of the URL, which may be long
+func linkPreviewKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return "link_preview:" + hex.EncodeToString(sum[:])
+}
+
+func (rd *RedisDriver) GetLinkPreview(url string) (models.LinkPreview, error) {
+	val, err := rd.connection.Get(rd.ctx, linkPreviewKey(url)).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return models.LinkPreview{}, LinkPreviewNotFound
+	case err != nil:
+		return models.LinkPreview{}, err
+	}
+
+	var preview models.LinkPreview
+	if err := json.Unmarshal([]byte(val), &preview); err != nil {
+		return models.LinkPreview{}, err
+	}
+
+	return preview, nil
+}
+
+func (rd *RedisDriver) CacheLinkPreview(preview models.LinkPreview, ttl time.Duration) error {
+	encoded, err := json.Marshal(preview)
+	if err != nil {
+		return err
+	}
+
+	return rd.connection.Set(rd.ctx, linkPreviewKey(preview.URL), encoded, ttl).Err()
+}
+
+func (rd *RedisDriver) SetMessagePreviews(messageID string, previews []models.LinkPreview) error {
+	encoded, err := json.Marshal(previews)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("message:%s", messageID)
+	set, err := setMessagePreviewsScript.Run(rd.ctx, rd.connection, []string{key}, encoded).Int()
+	if err != nil {
+		return err
+	}
+	if set == 0 {
+		return MessageNotFound
+	}
+
+	return nil
+}
+
+// endregion
+
+// region TopicRepository
+
+func (rd *RedisDriver) GetTopic() (models.Topic, error) {
+	val, err := rd.connection.HGetAll(rd.ctx, "topic").Result()
+	switch {
+	case errors.Is(err, redis.Nil) || len(val) == 0:
+		return models.Topic{}, nil
+	case err != nil:
+		return models.Topic{}, err
+	}
+
+	updatedAt, _ := strconv.Atoi(val["updatedAt"])
+	return models.Topic{
+		Text:      val["text"],
+		UserID:    val["userId"],
+		UpdatedAt: updatedAt,
+	}, nil
+}
+
+func (rd *RedisDriver) SetTopic(topic models.Topic) error {
+	_, err := rd.connection.HSet(
+		rd.ctx,
+		"topic",
+		map[string]interface{}{
+			"text":      topic.Text,
+			"userId":    topic.UserID,
+			"updatedAt": topic.UpdatedAt,
+		},
+	).Result()
+
+	return err
+}
+
+// endregion
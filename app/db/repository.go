@@ -15,6 +15,12 @@ var (
 	TokenNotFound         = fmt.Errorf("token not found")
 	TicketNotFound        = fmt.Errorf("ticket not found")
 	MessageNotFound       = fmt.Errorf("message not found")
+	MessageAlreadyStored  = fmt.Errorf("message with given id is already stored")
+	MessageIDTaken        = fmt.Errorf("message id belongs to another user")
+	UploadNotFound        = fmt.Errorf("upload not found")
+	LinkPreviewNotFound   = fmt.Errorf("link preview not found")
+	AuditEventNotCreated  = fmt.Errorf("audit event not created")
+	MailNotFound          = fmt.Errorf("mail not found")
 )
 
 type UserRepository interface {
@@ -24,6 +30,7 @@ type UserRepository interface {
 	GetUser(id string) (models.User, error)
 	GetUsers() []models.User
 	FindUserByEmail(email string) (models.User, error)
+	FindUserByUsername(username string) (models.User, error)
 	UpdateUserField(user *models.User, field string, value string) error
 }
 
@@ -35,12 +42,26 @@ type TicketRepository interface {
 
 type OnlineRepository interface {
 	GetOnlineUsers() []string
+	IsUserOnline(userUUID string) bool
 	CreateUserOnline(userUUID string) error
 	RemoveUserOnline(userUUID string) error
 }
 
 type MessageRepository interface {
-	StoreMessage(userID string, messageType int, messageUUID string, text string) (string, error)
+	// StoreMessage keeps the ID chosen by the client. Storing an ID again returns MessageAlreadyStored if the
+	// message is of the same user and MessageIDTaken otherwise, the stored message is not changed.
+	StoreMessage(
+		userID string,
+		messageType int,
+		messageUUID string,
+		text string,
+		mentions []string,
+		attachments []string,
+	) (string, error)
+	// StoreDirectMessage keeps a direct message for ttl, outside the history, so that a retry with the same ID
+	// gets MessageAlreadyStored and the kept message instead of sending it again. IDs are shared with
+	// StoreMessage: an ID of any other message gives MessageIDTaken.
+	StoreDirectMessage(message models.Message, recipientID string, ttl time.Duration) (models.Message, error)
 	GetMessage(id string) (models.Message, error)
 	GetMessages(count int) []models.Message
 }
@@ -59,3 +80,113 @@ type ResetPasswordTokenRepository interface {
 	FindResetPasswordTokenByString(token string) (models.PasswordResetToken, error)
 	RemoveResetPasswordToken(token models.PasswordResetToken) error
 }
+
+// AuditFilter narrows down GetAuditEvents. Empty fields are not applied, From and To are unix timestamps.
+type AuditFilter struct {
+	ActorID string
+	Type    string
+	From    int
+	To      int
+	Limit   int
+}
+
+// AuditRepository is an append-only storage of security-relevant events.
+type AuditRepository interface {
+	AppendAuditEvent(event models.AuditEvent) error
+	GetAuditEvents(filter AuditFilter) ([]models.AuditEvent, error)
+}
+
+// HealthRepository reports whether the underlying storage is reachable.
+type HealthRepository interface {
+	Ping(timeout time.Duration) error
+}
+
+// MailOutboxRepository is a durable queue of outgoing mails. Mails which failed permanently are kept
+// in a dead-letter set until they are requeued or removed.
+type MailOutboxRepository interface {
+	EnqueueMail(mail models.Mail) error
+	// ClaimDueMails returns mails whose delivery attempt is due and hides them from other claims for
+	// the lease duration, so a crashed sender does not lose them.
+	ClaimDueMails(limit int, lease time.Duration) ([]models.Mail, error)
+	MarkMailSent(mail models.Mail) error
+	RetryMail(mail models.Mail, nextAttemptAt time.Time) error
+	DeadLetterMail(mail models.Mail) error
+	GetDeadMails(limit int) ([]models.Mail, error)
+	RequeueDeadMail(id string) error
+	OutboxSize() (int, error)
+}
+
+type NotificationRepository interface {
+	GetNotificationPreferences(userID string) (models.NotificationPreferences, error)
+	SetNotificationPreferences(userID string, preferences models.NotificationPreferences) error
+	// AddDigestItem queues the item, the digest of the user becomes due at dueAt unless it is due already.
+	AddDigestItem(userID string, item models.DigestItem, dueAt time.Time) error
+	// ClaimDueDigests returns users whose digest is due and removes them from the schedule.
+	ClaimDueDigests(limit int) ([]string, error)
+	// ScheduleDigest makes the digest of the user due at dueAt unless it is due already, e.g. to retry it.
+	ScheduleDigest(userID string, dueAt time.Time) error
+	// GetDigestItems returns the queued items, oldest first. An item which cannot be decoded is returned
+	// empty, so that it is counted by RemoveDigestItems.
+	GetDigestItems(userID string) ([]models.DigestItem, error)
+	// RemoveDigestItems removes the count oldest items, the ones queued meanwhile are kept.
+	RemoveDigestItems(userID string, count int) error
+}
+
+// UploadRepository stores metadata of uploaded files, their content is kept in a storage.BlobStore.
+type UploadRepository interface {
+	CreateUpload(upload models.Upload) error
+	GetUpload(id string) (models.Upload, error)
+}
+
+// RetentionRepository stores the retention policy set by admins and prunes old messages.
+type RetentionRepository interface {
+	// GetRetentionPolicy returns the policy set by admins, the second value is false if there is none.
+	GetRetentionPolicy() (models.RetentionPolicy, bool, error)
+	SetRetentionPolicy(policy models.RetentionPolicy) error
+	ResetRetentionPolicy() error
+	// PruneMessages deletes up to limit oldest messages which are beyond the newest maxCount or were created
+	// before createdBefore, zero values are not applied. It returns the number of deleted messages.
+	PruneMessages(maxCount int, createdBefore int, limit int) (int, error)
+}
+
+// EventRepository is a bounded replay buffer of hub events.
+type EventRepository interface {
+	// AppendEvent assigns the next sequence number to the event and stores it, only the newest limit events
+	// are kept. It returns the sequence number.
+	AppendEvent(event models.HubEvent, limit int) (int64, error)
+	// GetEventsSince returns up to limit events with a sequence number greater than seq, oldest first. The
+	// second value is false if some of them are not buffered anymore or if seq was never assigned.
+	GetEventsSince(seq int64, limit int) ([]models.HubEvent, bool, error)
+}
+
+type LinkPreviewRepository interface {
+	// GetLinkPreview returns the cached preview of the URL, LinkPreviewNotFound if it was not fetched lately.
+	GetLinkPreview(url string) (models.LinkPreview, error)
+	CacheLinkPreview(preview models.LinkPreview, ttl time.Duration) error
+	// SetMessagePreviews returns MessageNotFound if the message was deleted meanwhile.
+	SetMessagePreviews(messageID string, previews []models.LinkPreview) error
+}
+
+// TopicRepository stores the topic of the chat, set by admins with /topic.
+type TopicRepository interface {
+	// GetTopic returns a Topic without text if none was set.
+	GetTopic() (models.Topic, error)
+	SetTopic(topic models.Topic) error
+}
+
+// SearchQuery narrows down SearchMessages. Empty fields are not applied, From and To are unix timestamps.
+type SearchQuery struct {
+	// case-folded terms as returned by search.Tokenize, a message must contain all of them
+	Terms    []string
+	AuthorID string
+	From     int
+	To       int
+	Offset   int
+	Limit    int
+}
+
+// SearchRepository looks messages up in the inverted index kept up to date by MessageRepository.
+type SearchRepository interface {
+	// SearchMessages returns a page of matching messages, newest first, and the number of all matches.
+	SearchMessages(query SearchQuery) ([]models.Message, int, error)
+}
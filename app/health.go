@@ -0,0 +1,72 @@
+package app
+
+import (
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// ReadinessCheck returns an error when the component cannot serve traffic.
+type ReadinessCheck func(timeout time.Duration) error
+
+// AddReadinessCheck registers a component reported by /readyz.
+// Components living outside the App, like the websocket hub, are registered by main.
+func (app *App) AddReadinessCheck(name string, check ReadinessCheck) {
+	app.readinessMu.Lock()
+	app.readinessChecks[name] = check
+	app.readinessMu.Unlock()
+}
+
+func (app *App) HealthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sendResponse(w, models.JsonHealth{Status: models.HealthUp}, http.StatusOK)
+	}
+}
+
+func (app *App) ReadyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app.readinessMu.Lock()
+		checks := make(map[string]ReadinessCheck, len(app.readinessChecks))
+		for name, check := range app.readinessChecks {
+			checks[name] = check
+		}
+		app.readinessMu.Unlock()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		response := models.JsonHealth{
+			Status:     models.HealthUp,
+			Components: make(map[string]models.JsonComponentHealth, len(checks)),
+		}
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check ReadinessCheck) {
+				defer wg.Done()
+
+				component := models.JsonComponentHealth{Status: models.HealthUp}
+				if err := check(readinessTimeout); err != nil {
+					component = models.JsonComponentHealth{Status: models.HealthDown, Error: err.Error()}
+				}
+
+				mu.Lock()
+				response.Components[name] = component
+				if component.Status == models.HealthDown {
+					response.Status = models.HealthDown
+				}
+				mu.Unlock()
+			}(name, check)
+		}
+		wg.Wait()
+
+		status := http.StatusOK
+		if response.Status == models.HealthDown {
+			logger.FromContext(r.Context()).Warn("[http] Not ready: %v\n", response.Components)
+			status = http.StatusServiceUnavailable
+		}
+		sendResponse(w, response, status)
+	}
+}
@@ -2,14 +2,21 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/mazanax/go-chat/app/logger"
-	"github.com/mazanax/go-chat/config"
+	"github.com/mazanax/go-chat/app/models"
+	htmltemplate "html/template"
 	"net/http"
 	"strings"
+	"time"
 )
 
-var Unauthorized = fmt.Errorf("unathorized")
+var (
+	Unauthorized = fmt.Errorf("unathorized")
+	Forbidden    = fmt.Errorf("forbidden")
+)
 
 func parse(r *http.Request, data interface{}) error {
 	return json.NewDecoder(r.Body).Decode(data)
@@ -47,6 +54,104 @@ func sendResponse(w http.ResponseWriter, data interface{}, status int) {
 	}
 }
 
-func publicLink(endpoint string) string {
-	return strings.TrimRight(config.PublicHost, "/") + "/" + strings.TrimLeft(endpoint, "/")
+// sendPage renders an HTML page, for the few endpoints opened in a browser rather than by the client.
+func sendPage(w http.ResponseWriter, page *htmltemplate.Template, data interface{}) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := page.Execute(w, data); err != nil {
+		logger.Error("Cannot render page. err=%v\n", err)
+	}
+}
+
+func (app *App) publicLink(endpoint string) string {
+	return strings.TrimRight(app.publicHost, "/") + "/" + strings.TrimLeft(endpoint, "/")
+}
+
+// preferredLocale returns the primary language of the first Accept-Language entry, e.g. "ru" for "ru-RU,en;q=0.8".
+func preferredLocale(r *http.Request) string {
+	tag := strings.Split(r.Header.Get("Accept-Language"), ",")[0]
+	tag = strings.Split(strings.Split(tag, ";")[0], "-")[0]
+
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// currentUser resolves the user behind the bearer token of the request.
+func (app *App) currentUser(r *http.Request) (models.User, error) {
+	if err := checkAuthorization(r); err != nil {
+		return models.User{}, err
+	}
+
+	accessToken, err := app.AccessTokenRepository.FindTokenByString(parseToken(r))
+	if err != nil {
+		return models.User{}, Unauthorized
+	}
+
+	user, err := app.UserRepository.GetUser(accessToken.UserID)
+	if err != nil {
+		return models.User{}, Unauthorized
+	}
+
+	return user, nil
+}
+
+// currentAdmin works like currentUser, but also requires the user to be listed in Config.AdminUsers.
+func (app *App) currentAdmin(r *http.Request) (models.User, error) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		return user, err
+	}
+
+	if !app.isAdmin(user) {
+		return user, Forbidden
+	}
+
+	return user, nil
+}
+
+// isAdmin tells whether the user is listed in Config.AdminUsers.
+func (app *App) isAdmin(user models.User) bool {
+	return app.adminUsers[strings.ToLower(user.Username)]
+}
+
+// requireAdmin writes the error response and returns false when the request is not made by an admin.
+func (app *App) requireAdmin(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	log := logger.FromContext(r.Context())
+	user, err := app.currentAdmin(r)
+	switch {
+	case errors.Is(err, Unauthorized):
+		log.Debug("[http] Unauthorized\n")
+		sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
+		return user, false
+	case errors.Is(err, Forbidden):
+		log.Debug("[http] Forbidden: %s %s\n", r.Method, r.URL)
+		sendResponse(w, models.Forbidden, http.StatusForbidden)
+		return user, false
+	}
+
+	return user, true
+}
+
+// notifyUserUpdated tells the connected clients to refresh their copy of the public profile.
+func (app *App) notifyUserUpdated(user models.User) {
+	app.notifications <- &models.Message{
+		ID:        uuid.NewString(),
+		UserID:    user.ID,
+		Type:      models.UserUpdated,
+		Data:      mapUserToJson(user, false),
+		CreatedAt: int(time.Now().Unix()),
+	}
+}
+
+func (app *App) audit(r *http.Request, eventType string, actorID string, targetID string, data map[string]string) {
+	err := app.AuditRepository.AppendAuditEvent(models.AuditEvent{
+		Type:     eventType,
+		ActorID:  actorID,
+		TargetID: targetID,
+		IP:       app.trustedProxies.ClientIP(r),
+		Data:     data,
+	})
+	if err != nil {
+		logger.FromContext(r.Context()).Error("[audit] Cannot store %s event for %s: %s\n", eventType, actorID, err)
+	}
 }
@@ -8,19 +8,56 @@ import (
 	"github.com/mazanax/go-chat/app/logger"
 	"github.com/mazanax/go-chat/app/mailer"
 	"github.com/mazanax/go-chat/app/models"
+	"github.com/mazanax/go-chat/app/notifier"
 	"github.com/mazanax/go-chat/app/requests"
+	"github.com/mazanax/go-chat/app/search"
 	"github.com/mazanax/go-chat/app/tokens"
+	htmltemplate "html/template"
 	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// length of the highlighted excerpt in search results, in characters
+const snippetLength = 160
+
+// unsubscribePage is shown by the link in notification emails. Opening the link only asks, since mail scanners
+// and link previews follow links too; the form posts back to the same URL.
+var unsubscribePage = htmltemplate.Must(htmltemplate.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+{{if .Done}}
+<p>You will no longer receive emails about {{.What}}.</p>
+{{else}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="confirm" value="yes">
+<p>Stop receiving emails about {{.What}}?</p>
+<button type="submit">Unsubscribe</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// what the kinds of unsubscribe links turn off, as shown on the page
+var unsubscribeWhat = map[string]string{
+	notifier.UnsubscribeMentions:       "mentions",
+	notifier.UnsubscribeDirectMessages: "direct messages",
+	notifier.UnsubscribeAll:            "mentions and direct messages",
+}
+
 // region HttpHandlers
 
 func (app *App) UsersHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 		if err := checkAuthorization(r); errors.Is(err, Unauthorized) {
-			logger.Debug("[http] Unauthorized\n")
+			log.Debug("[http] Unauthorized\n")
 			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
 			return
 		}
@@ -41,9 +78,10 @@ func (app *App) UsersHandler() http.HandlerFunc {
 
 func (app *App) OnlineHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 		if err := checkAuthorization(r); errors.Is(err, Unauthorized) {
-			logger.Debug("[http] Unauthorized\n")
+			log.Debug("[http] Unauthorized\n")
 			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
 			return
 		}
@@ -55,25 +93,26 @@ func (app *App) OnlineHandler() http.HandlerFunc {
 
 func (app *App) SignUpHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 		req := models.CreateUserRequest{}
 		err := parse(r, &req)
 		if err != nil {
-			logger.Error("[http] Cannot parse post body. err=%v\n", err)
+			log.Warn("[http] Cannot parse post body. err=%v\n", err)
 			sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
 			return
 		}
 
 		validationErrors := requests.Validate(req)
 		if len(validationErrors) > 0 {
-			logger.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
+			log.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
 			sendResponse(w, nil, http.StatusBadRequest)
 			return
 		}
 
 		encryptedPassword, err := app.passwordEncryptor.GenerateHash(req.Password)
 		if err != nil {
-			logger.Debug("[http] Cannot encode password: %s\n", err)
+			log.Debug("[http] Cannot encode password: %s\n", err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
@@ -81,26 +120,27 @@ func (app *App) SignUpHandler() http.HandlerFunc {
 		uuid_, err := app.UserRepository.CreateUser(req.Email, req.Username, req.Name, encryptedPassword)
 		switch {
 		case errors.Is(err, db.EmailAlreadyExists):
-			logger.Debug("[http] User with email %s already exists: %s %s\n", req.Email, r.Method, r.URL)
+			log.Debug("[http] User with email %s already exists: %s %s\n", req.Email, r.Method, r.URL)
 			sendResponse(w, models.EmailAlreadyExists, http.StatusBadRequest)
 			return
 		case errors.Is(err, db.UsernameAlreadyExists):
-			logger.Debug("[http] User with username %s already exists: %s %s\n", req.Username, r.Method, r.URL)
+			log.Debug("[http] User with username %s already exists: %s %s\n", req.Username, r.Method, r.URL)
 			sendResponse(w, models.UsernameAlreadyExists, http.StatusBadRequest)
 			return
 		case err != nil:
-			logger.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
 		user, err := app.UserRepository.GetUser(uuid_)
 		if err != nil && errors.Is(err, db.UserNotFound) {
-			logger.Debug("[http] User #%s not found\n", uuid_)
+			log.Debug("[http] User #%s not found\n", uuid_)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
+		app.audit(r, models.AuditSignUp, user.ID, user.ID, map[string]string{"username": user.Username})
 		app.notifications <- &models.Message{
 			ID:        uuid.NewString(),
 			Type:      models.UserRegistered,
@@ -113,10 +153,11 @@ func (app *App) SignUpHandler() http.HandlerFunc {
 
 func (app *App) UserHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 
 		if err := checkAuthorization(r); errors.Is(err, Unauthorized) {
-			logger.Debug("[http] Unauthorized\n")
+			log.Debug("[http] Unauthorized\n")
 			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
 			return
 		}
@@ -133,6 +174,7 @@ func (app *App) UserHandler() http.HandlerFunc {
 }
 
 func (app *App) getUser(w http.ResponseWriter, r *http.Request) {
+	log := logger.FromContext(r.Context())
 	tokenString := parseToken(r)
 	accessToken, err := app.AccessTokenRepository.FindTokenByString(tokenString)
 	if err != nil {
@@ -152,7 +194,7 @@ func (app *App) getUser(w http.ResponseWriter, r *http.Request) {
 
 	user, err := app.UserRepository.GetUser(uuid_)
 	if err != nil && errors.Is(err, db.UserNotFound) {
-		logger.Debug("[http] User #%s not found\n", uuid_)
+		log.Debug("[http] User #%s not found\n", uuid_)
 		sendResponse(w, models.UserNotFound, http.StatusNotFound)
 		return
 	}
@@ -161,10 +203,11 @@ func (app *App) getUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) patchUser(w http.ResponseWriter, r *http.Request) {
+	log := logger.FromContext(r.Context())
 	tokenString := parseToken(r)
 	accessToken, err := app.AccessTokenRepository.FindTokenByString(tokenString)
 	if err != nil || len(accessToken.Token) == 0 {
-		logger.Debug("[http] Unauthorized\n")
+		log.Debug("[http] Unauthorized\n")
 		sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
 		return
 	}
@@ -172,54 +215,77 @@ func (app *App) patchUser(w http.ResponseWriter, r *http.Request) {
 	req := models.UpdateUserRequest{}
 	err = parse(r, &req)
 	if err != nil {
-		logger.Error("[http] Cannot parse post body. err=%v\n", err)
+		log.Warn("[http] Cannot parse post body. err=%v\n", err)
 		sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
 		return
 	}
 
 	validationErrors := requests.Validate(req)
 	if len(validationErrors) > 0 {
-		logger.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
+		log.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
 		sendResponse(w, nil, http.StatusBadRequest)
 		return
 	}
 
 	user, err := app.UserRepository.GetUser(accessToken.UserID)
 	if err != nil && errors.Is(err, db.UserNotFound) {
-		logger.Debug("[http] User #%s not found\n", accessToken.UserID)
+		log.Debug("[http] User #%s not found\n", accessToken.UserID)
 		sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 		return
 	}
 
+	var changed []string
 	if len(req.Email) > 0 {
+		changed = append(changed, "email")
 		err := app.UserRepository.UpdateUserField(&user, "email", req.Email)
 		if err != nil {
-			logger.Debug("[http] Cannot update user #%s email: %s\n", accessToken.UserID, err)
+			log.Debug("[http] Cannot update user #%s email: %s\n", accessToken.UserID, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 	}
 
 	if len(req.Name) > 0 {
+		changed = append(changed, "name")
 		err := app.UserRepository.UpdateUserField(&user, "name", req.Name)
 		if err != nil {
-			logger.Debug("[http] Cannot update user #%s name: %s\n", accessToken.UserID, err)
+			log.Debug("[http] Cannot update user #%s name: %s\n", accessToken.UserID, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for field, value := range map[string]*string{
+		"bio":      req.Bio,
+		"status":   req.Status,
+		"timezone": req.Timezone,
+		"pronouns": req.Pronouns,
+	} {
+		if value == nil {
+			continue
+		}
+
+		changed = append(changed, field)
+		err := app.UserRepository.UpdateUserField(&user, field, strings.TrimSpace(*value))
+		if err != nil {
+			log.Debug("[http] Cannot update user #%s %s: %s\n", accessToken.UserID, field, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 	}
 
 	if len(req.Password) > 0 {
+		changed = append(changed, "password")
 		encryptedPassword, err := app.passwordEncryptor.GenerateHash(req.Password)
 		if err != nil {
-			logger.Debug("[http] Cannot encrypt user #%s password: %s\n", accessToken.UserID, err)
+			log.Debug("[http] Cannot encrypt user #%s password: %s\n", accessToken.UserID, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
 		err = app.UserRepository.UpdateUserField(&user, "password", encryptedPassword)
 		if err != nil {
-			logger.Debug("[http] Cannot update user #%s email: %s\n", accessToken.UserID, err)
+			log.Debug("[http] Cannot update user #%s email: %s\n", accessToken.UserID, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
@@ -227,69 +293,89 @@ func (app *App) patchUser(w http.ResponseWriter, r *http.Request) {
 
 	token, err := app.PasswordResetTokenRepository.FindResetPasswordTokenByUser(&user)
 	if err != nil && !errors.Is(err, db.TokenNotFound) {
-		logger.Debug("[http] Cannot get reset token for user #%s: %s\n", accessToken.UserID, err)
+		log.Debug("[http] Cannot get reset token for user #%s: %s\n", accessToken.UserID, err)
 		sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 		return
 	}
 	err = app.PasswordResetTokenRepository.RemoveResetPasswordToken(token)
 	if err != nil {
-		logger.Debug("[http] Cannot remove reset token for user #%s: %s\n", accessToken.UserID, err)
+		log.Debug("[http] Cannot remove reset token for user #%s: %s\n", accessToken.UserID, err)
 		sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 		return
 	}
 
+	if len(changed) > 0 {
+		err = app.UserRepository.UpdateUserField(&user, "updatedAt", strconv.FormatInt(time.Now().Unix(), 10))
+		if err != nil {
+			log.Debug("[http] Cannot update user #%s updatedAt: %s\n", accessToken.UserID, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sort.Strings(changed)
+	app.audit(r, models.AuditProfileUpdated, user.ID, user.ID, map[string]string{"fields": strings.Join(changed, ",")})
 	user, _ = app.UserRepository.GetUser(accessToken.UserID)
+	if len(changed) > 0 {
+		app.notifyUserUpdated(user)
+	}
 	sendResponse(w, mapUserToJson(user, true), http.StatusOK)
 }
 
 func (app *App) LoginHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 
 		req := models.LoginRequest{}
 		err := parse(r, &req)
 		if err != nil {
-			logger.Error("[http] Cannot parse post body. err=%v\n", err)
+			log.Warn("[http] Cannot parse post body. err=%v\n", err)
 			sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
 			return
 		}
 
 		validationErrors := requests.Validate(req)
 		if len(validationErrors) > 0 {
-			logger.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
+			log.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
 			sendResponse(w, nil, http.StatusUnauthorized)
 			return
 		}
 
 		user, err := app.UserRepository.FindUserByEmail(req.Email)
 		if err != nil {
-			logger.Debug("[http] User %s not found: %s %s\n", req.Email, r.Method, r.URL)
+			log.Debug("[http] User %s not found: %s %s\n", req.Email, r.Method, r.URL)
+			app.audit(r, models.AuditLoginFailed, "", "", map[string]string{"email": req.Email})
 			sendResponse(w, models.InvalidCredentials, http.StatusUnauthorized)
 			return
 		}
 
 		if !app.passwordEncryptor.CompareHasAndPassword(req.Password, user.Password) {
-			logger.Debug("[http] Invalid password %s: %s %s\n", req.Email, r.Method, r.URL)
+			log.Debug("[http] Invalid password %s: %s %s\n", req.Email, r.Method, r.URL)
+			app.audit(r, models.AuditLoginFailed, "", user.ID, map[string]string{"email": req.Email})
 			sendResponse(w, models.InvalidCredentials, http.StatusUnauthorized)
 			return
 		}
 
 		token, err := tokens.NewToken(app.AccessTokenRepository, &user)
 		if err != nil {
-			logger.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
+		app.audit(r, models.AuditLogin, user.ID, user.ID, nil)
+		app.audit(r, models.AuditTokenCreated, user.ID, token.ID, map[string]string{"via": "login"})
 		sendResponse(w, mapAccessTokenToJson(token), http.StatusOK)
 	}
 }
 
 func (app *App) LogoutHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 		if err := checkAuthorization(r); errors.Is(err, Unauthorized) {
-			logger.Debug("[http] Unauthorized\n")
+			log.Debug("[http] Unauthorized\n")
 			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
 			return
 		}
@@ -299,36 +385,38 @@ func (app *App) LogoutHandler() http.HandlerFunc {
 
 		err := app.AccessTokenRepository.RemoveToken(accessToken)
 		if err != nil {
-			logger.Debug("[http] Cannot remove access token: %s\n", err)
+			log.Debug("[http] Cannot remove access token: %s\n", err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
+		app.audit(r, models.AuditLogout, accessToken.UserID, accessToken.ID, nil)
 		sendResponse(w, nil, http.StatusOK)
 	}
 }
 
 func (app *App) ResetPasswordHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 
 		req := models.PasswordResetRequest{}
 		err := parse(r, &req)
 		if err != nil {
-			logger.Error("[http] Cannot parse post body. err=%v\n", err)
+			log.Warn("[http] Cannot parse post body. err=%v\n", err)
 			sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
 			return
 		}
 
 		validationErrors := requests.Validate(req)
 		if len(validationErrors) > 0 {
-			logger.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
+			log.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
 			sendResponse(w, nil, http.StatusBadRequest)
 			return
 		}
 
 		user, err := app.UserRepository.FindUserByEmail(req.Email)
 		if err != nil {
-			logger.Debug("[http] User %s not found: %s %s\n", req.Email, r.Method, r.URL)
+			log.Debug("[http] User %s not found: %s %s\n", req.Email, r.Method, r.URL)
 			sendResponse(w, nil, http.StatusOK)
 			return
 		}
@@ -339,23 +427,34 @@ func (app *App) ResetPasswordHandler() http.HandlerFunc {
 		case errors.Is(err, db.TokenNotFound):
 			token, err = tokens.NewPasswordResetToken(app.PasswordResetTokenRepository, &user)
 			if err != nil {
-				logger.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+				log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
 				sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 				return
 			}
 			created = true
 		case err != nil:
-			logger.Debug("[http] Cannot get reset token for user #%s: %s\n", user.ID, err)
+			log.Debug("[http] Cannot get reset token for user #%s: %s\n", user.ID, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
-		logger.Debug("[password reset] Code: %s\n", token.Token)
 		if created {
-			app.Mailer.Enqueue(
-				user.Email,
-				mailer.PasswordRecoveryEmail(user.Username, user.Email, publicLink("/reset-password?code="+token.Token)),
-				"Password Recovery - MZNX Chat",
+			app.audit(r, models.AuditPasswordResetRequested, "", user.ID, nil)
+			err = app.Mailer.EnqueueTemplate(
+				mailer.PasswordRecoveryTemplate,
+				preferredLocale(r),
+				mail.Address{Name: user.Name, Address: user.Email},
+				map[string]interface{}{
+					"Username": user.Username,
+					"Email":    user.Email,
+					"Link":     app.publicLink("/reset-password?code=" + token.Token),
+					"ValidFor": tokens.ResetPasswordTokenDurationMinutes,
+				},
 			)
+			if err != nil {
+				log.Error("[http] Cannot enqueue password recovery mail for user #%s: %s\n", user.ID, err)
+				sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+				return
+			}
 		}
 
 		sendResponse(w, nil, http.StatusOK)
@@ -364,19 +463,20 @@ func (app *App) ResetPasswordHandler() http.HandlerFunc {
 
 func (app *App) TokenHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 
 		req := models.TokenByCodeRequest{}
 		err := parse(r, &req)
 		if err != nil {
-			logger.Error("[http] Cannot parse post body. err=%v\n", err)
+			log.Warn("[http] Cannot parse post body. err=%v\n", err)
 			sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
 			return
 		}
 
 		validationErrors := requests.Validate(req)
 		if len(validationErrors) > 0 {
-			logger.Debug("[http] Forbidden: %s %s\n", r.Method, r.URL)
+			log.Debug("[http] Forbidden: %s %s\n", r.Method, r.URL)
 			sendResponse(w, nil, http.StatusForbidden)
 			return
 		}
@@ -384,38 +484,41 @@ func (app *App) TokenHandler() http.HandlerFunc {
 		token, err := app.PasswordResetTokenRepository.FindResetPasswordTokenByString(req.Code)
 		switch {
 		case errors.Is(err, db.TokenNotFound):
-			logger.Debug("[http] Password reset token %s not found: %s %s\n", req.Code, r.Method, r.URL)
+			log.With("code", req.Code).Debug("[http] Password reset token not found: %s %s\n", r.Method, r.URL)
 			sendResponse(w, nil, http.StatusForbidden)
 			return
 		case err != nil:
-			logger.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
 		user, err := app.UserRepository.GetUser(token.UserID)
 		if err != nil {
-			logger.Debug("[http] User %s not found: %s %s\n", req.Code, r.Method, r.URL)
+			log.Error("[http] User #%s not found: %s %s\n", token.UserID, r.Method, r.URL)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
 		accessToken, err := tokens.NewToken(app.AccessTokenRepository, &user)
 		if err != nil {
-			logger.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
+		app.audit(r, models.AuditPasswordReset, user.ID, user.ID, nil)
+		app.audit(r, models.AuditTokenCreated, user.ID, accessToken.ID, map[string]string{"via": "reset_code"})
 		sendResponse(w, mapAccessTokenToJson(accessToken), http.StatusCreated)
 	}
 }
 
 func (app *App) TicketHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 		if err := checkAuthorization(r); errors.Is(err, Unauthorized) {
-			logger.Debug("[http] Unauthorized\n")
+			log.Debug("[http] Unauthorized\n")
 			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
 			return
 		}
@@ -425,18 +528,20 @@ func (app *App) TicketHandler() http.HandlerFunc {
 
 		ticket, err := tokens.NewTicket(app.TicketRepository, &accessToken)
 		if err != nil {
-			logger.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
 			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
 			return
 		}
 
+		app.audit(r, models.AuditTicketCreated, accessToken.UserID, accessToken.ID, nil)
 		sendResponse(w, mapTicketToJson(ticket), http.StatusCreated)
 	}
 }
 
 func (app *App) HistoryHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
 
 		var jsonMessages []models.JsonMessage
 		messages := app.MessageRepository.GetMessages(100)
@@ -449,4 +554,369 @@ func (app *App) HistoryHandler() http.HandlerFunc {
 	}
 }
 
+// SearchHandler finds messages containing every word of q. Results are paged by limit and offset and can be
+// narrowed down to an author (user ID or username) and to a period between the from and to unix timestamps.
+func (app *App) SearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+		if _, err := app.currentUser(r); err != nil {
+			log.Debug("[http] Unauthorized\n")
+			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query()
+		searchQuery := db.SearchQuery{
+			Terms: search.Tokenize(query.Get("q")),
+			Limit: 20,
+		}
+		if len(searchQuery.Terms) == 0 {
+			log.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
+			sendResponse(w, models.ErrorResponse{
+				Message: "Invalid query parameter",
+				Errors:  map[string]string{"q": "Must contain at least one word"},
+				Code:    http.StatusBadRequest,
+			}, http.StatusBadRequest)
+			return
+		}
+
+		for name, target := range map[string]*int{
+			"from":   &searchQuery.From,
+			"to":     &searchQuery.To,
+			"limit":  &searchQuery.Limit,
+			"offset": &searchQuery.Offset,
+		} {
+			if len(query.Get(name)) == 0 {
+				continue
+			}
+
+			value, err := strconv.Atoi(query.Get(name))
+			if err != nil || value < 0 {
+				log.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
+				sendResponse(w, models.ErrorResponse{
+					Message: "Invalid query parameter",
+					Errors:  map[string]string{name: "Must be a non-negative integer"},
+					Code:    http.StatusBadRequest,
+				}, http.StatusBadRequest)
+				return
+			}
+			*target = value
+		}
+		if searchQuery.Limit == 0 || searchQuery.Limit > 100 {
+			searchQuery.Limit = 100
+		}
+
+		if author := query.Get("author"); len(author) > 0 {
+			user, err := app.UserRepository.GetUser(author)
+			if err != nil {
+				user, err = app.UserRepository.FindUserByUsername(author)
+			}
+			if err != nil {
+				log.Debug("[http] Author %s not found\n", author)
+				sendResponse(w, models.UserNotFound, http.StatusNotFound)
+				return
+			}
+			searchQuery.AuthorID = user.ID
+		}
+
+		messages, total, err := app.SearchRepository.SearchMessages(searchQuery)
+		if err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		response := models.JsonSearchResponse{
+			Total:   total,
+			Results: make([]models.JsonSearchResult, 0, len(messages)),
+		}
+		for _, message := range messages {
+			response.Results = append(response.Results, models.JsonSearchResult{
+				Message: mapMessageToJson(message),
+				Snippet: search.Snippet(message.Text, searchQuery.Terms, snippetLength),
+			})
+		}
+
+		sendResponse(w, response, http.StatusOK)
+	}
+}
+
+// TopicHandler returns the topic set with /topic, its text is empty if there is none.
+func (app *App) TopicHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+		if _, err := app.currentUser(r); err != nil {
+			log.Debug("[http] Unauthorized\n")
+			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		topic, err := app.TopicRepository.GetTopic()
+		if err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		sendResponse(w, mapTopicToJson(topic), http.StatusOK)
+	}
+}
+
+func (app *App) AuditHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		if _, ok := app.requireAdmin(w, r); !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		filter := db.AuditFilter{
+			ActorID: query.Get("actor"),
+			Type:    query.Get("type"),
+			Limit:   100,
+		}
+		for name, target := range map[string]*int{"from": &filter.From, "to": &filter.To, "limit": &filter.Limit} {
+			if len(query.Get(name)) == 0 {
+				continue
+			}
+
+			value, err := strconv.Atoi(query.Get(name))
+			if err != nil || value < 0 {
+				log.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
+				sendResponse(w, models.ErrorResponse{
+					Message: "Invalid query parameter",
+					Errors:  map[string]string{name: "Must be a non-negative integer"},
+					Code:    http.StatusBadRequest,
+				}, http.StatusBadRequest)
+				return
+			}
+			*target = value
+		}
+
+		events, err := app.AuditRepository.GetAuditEvents(filter)
+		if err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		jsonEvents := make([]models.JsonAuditEvent, 0, len(events))
+		for _, event := range events {
+			jsonEvents = append(jsonEvents, mapAuditEventToJson(event))
+		}
+
+		sendResponse(w, jsonEvents, http.StatusOK)
+	}
+}
+
+// RetentionHandler shows the effective retention policy (GET), overrides it (PUT) or goes back to the
+// configured one (DELETE). A changed policy is applied right away.
+func (app *App) RetentionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		admin, ok := app.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			req := models.UpdateRetentionPolicyRequest{}
+			if err := parse(r, &req); err != nil {
+				log.Warn("[http] Cannot parse post body. err=%v\n", err)
+				sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
+				return
+			}
+
+			validationErrors := requests.Validate(req)
+			if len(validationErrors) > 0 {
+				log.Debug("[http] Bad request: %s %s\n", r.Method, r.URL)
+				sendResponse(w, nil, http.StatusBadRequest)
+				return
+			}
+
+			err := app.RetentionRepository.SetRetentionPolicy(models.RetentionPolicy{
+				MaxAge:   time.Duration(req.MaxAge) * time.Second,
+				MaxCount: req.MaxCount,
+			})
+			if err != nil {
+				log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+				sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+				return
+			}
+		case http.MethodDelete:
+			if err := app.RetentionRepository.ResetRetentionPolicy(); err != nil {
+				log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+				sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		policy, overridden, err := app.Janitor.Policy()
+		if err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			app.audit(r, models.AuditRetentionChanged, admin.ID, "", map[string]string{
+				"max_age":   policy.MaxAge.String(),
+				"max_count": strconv.Itoa(policy.MaxCount),
+			})
+			app.Janitor.Prune()
+		}
+
+		sendResponse(w, mapRetentionPolicyToJson(policy, overridden), http.StatusOK)
+	}
+}
+
+func (app *App) DeadMailsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		if _, ok := app.requireAdmin(w, r); !ok {
+			return
+		}
+
+		mails, err := app.MailOutboxRepository.GetDeadMails(100)
+		if err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		jsonMails := make([]models.JsonMail, 0, len(mails))
+		for _, mail := range mails {
+			jsonMails = append(jsonMails, mapMailToJson(mail))
+		}
+
+		sendResponse(w, jsonMails, http.StatusOK)
+	}
+}
+
+func (app *App) RequeueMailHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+		admin, ok := app.requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		err := app.MailOutboxRepository.RequeueDeadMail(id)
+		switch {
+		case errors.Is(err, db.MailNotFound):
+			log.Debug("[http] Dead mail #%s not found\n", id)
+			sendResponse(w, models.NotFound, http.StatusNotFound)
+			return
+		case err != nil:
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(r, models.AuditMailRequeued, admin.ID, id, nil)
+		sendResponse(w, nil, http.StatusAccepted)
+	}
+}
+
+func (app *App) NotificationPreferencesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+		user, err := app.currentUser(r)
+		if err != nil {
+			log.Debug("[http] Unauthorized\n")
+			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		preferences, err := app.NotificationRepository.GetNotificationPreferences(user.ID)
+		if err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			sendResponse(w, mapNotificationPreferencesToJson(preferences), http.StatusOK)
+			return
+		}
+
+		var req models.UpdateNotificationPreferencesRequest
+		if err := parse(r, &req); err != nil {
+			log.Warn("[http] Cannot parse post body. err=%v\n", err)
+			sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
+			return
+		}
+
+		if req.Mentions != nil {
+			preferences.Mentions = *req.Mentions
+		}
+		if req.DirectMessages != nil {
+			preferences.DirectMessages = *req.DirectMessages
+		}
+
+		if err := app.NotificationRepository.SetNotificationPreferences(user.ID, preferences); err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(r, models.AuditNotificationsUpdated, user.ID, user.ID, map[string]string{
+			"mentions":        strconv.FormatBool(preferences.Mentions),
+			"direct_messages": strconv.FormatBool(preferences.DirectMessages),
+		})
+		sendResponse(w, mapNotificationPreferencesToJson(preferences), http.StatusOK)
+	}
+}
+
+// UnsubscribeHandler serves the links from notification emails. GET is the link in the body and renders a page
+// asking to confirm, POST unsubscribes: from that page or as the one-click unsubscribe of mail clients
+// (RFC 8058). Both take the signed parameters from the query.
+func (app *App) UnsubscribeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+		query := r.URL.Query()
+		userID, kind := query.Get("user"), query.Get("kind")
+		if !app.Notifier.VerifyUnsubscribe(userID, kind, query.Get("signature")) {
+			log.Debug("[http] Invalid unsubscribe link\n")
+			sendResponse(w, models.Forbidden, http.StatusForbidden)
+			return
+		}
+
+		page := map[string]interface{}{"What": unsubscribeWhat[kind], "Action": r.URL.RequestURI()}
+		if r.Method == http.MethodGet {
+			sendPage(w, unsubscribePage, page)
+			return
+		}
+
+		preferences, err := app.Notifier.Unsubscribe(userID, kind)
+		if err != nil {
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(r, models.AuditUnsubscribed, userID, userID, map[string]string{"kind": kind})
+		if r.PostFormValue("confirm") != "" {
+			page["Done"] = true
+			sendPage(w, unsubscribePage, page)
+			return
+		}
+		sendResponse(w, mapNotificationPreferencesToJson(preferences), http.StatusOK)
+	}
+}
+
 // endregion
@@ -0,0 +1,157 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"github.com/mazanax/go-chat/app/db"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/models"
+	"time"
+)
+
+// messages pruned in one Redis transaction
+const pruneBatch = 500
+
+var JanitorNotRunning = fmt.Errorf("janitor is not running")
+
+type Config struct {
+	// used unless an admin has set another policy
+	Policy models.RetentionPolicy
+	// how often the history is pruned
+	Interval time.Duration
+}
+
+// Janitor deletes messages which are older or beyond the limits of the retention policy.
+type Janitor struct {
+	repository    db.RetentionRepository
+	defaultPolicy models.RetentionPolicy
+	interval      time.Duration
+
+	// Prune wakes Run up so a new policy is applied right away
+	wakeup chan struct{}
+	// liveness probes, Run closes every received channel
+	ping chan chan struct{}
+}
+
+func New(config Config, repository db.RetentionRepository) *Janitor {
+	return &Janitor{
+		repository:    repository,
+		defaultPolicy: config.Policy,
+		interval:      config.Interval,
+
+		wakeup: make(chan struct{}, 1),
+		ping:   make(chan chan struct{}),
+	}
+}
+
+// Policy returns the effective retention policy and whether it was set by an admin.
+func (j *Janitor) Policy() (models.RetentionPolicy, bool, error) {
+	policy, overridden, err := j.repository.GetRetentionPolicy()
+	if err != nil || !overridden {
+		return j.defaultPolicy, false, err
+	}
+
+	return policy, true, nil
+}
+
+// Prune asks Run for a pass without waiting for the interval.
+func (j *Janitor) Prune() {
+	select {
+	case j.wakeup <- struct{}{}:
+	default: // Run is already woken up
+	}
+}
+
+// Run prunes the history every interval until the context is cancelled.
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	j.prune(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("[janitor] Stopped\n")
+			return
+		case reply := <-j.ping:
+			// probes do no work, or every readiness check would be a pass over the history
+			close(reply)
+		case <-j.wakeup:
+			j.prune(ctx)
+		case <-ticker.C:
+			j.prune(ctx)
+		}
+	}
+}
+
+func (j *Janitor) prune(ctx context.Context) {
+	defer runDuration.ObserveSince(time.Now())
+
+	policy, _, err := j.Policy()
+	if err != nil {
+		logger.Error("[janitor] Cannot get retention policy: %s\n", err)
+		return
+	}
+	if policy.MaxCount == 0 && policy.MaxAge == 0 {
+		return
+	}
+
+	// count first, so that the metric tells which limit was exceeded
+	total := 0
+	for _, step := range []struct {
+		reason        string
+		maxCount      int
+		createdBefore int
+	}{
+		{reason: "count", maxCount: policy.MaxCount},
+		{reason: "age", createdBefore: createdBefore(policy.MaxAge)},
+	} {
+		if step.maxCount == 0 && step.createdBefore == 0 {
+			continue
+		}
+
+		for ctx.Err() == nil {
+			pruned, err := j.repository.PruneMessages(step.maxCount, step.createdBefore, pruneBatch)
+			if err != nil {
+				logger.Error("[janitor] Cannot prune messages: %s\n", err)
+				return
+			}
+
+			prunedMessages.WithLabelValues(step.reason).Add(float64(pruned))
+			total += pruned
+			if pruned < pruneBatch {
+				break
+			}
+		}
+	}
+
+	if total > 0 {
+		logger.With("max_count", policy.MaxCount, "max_age", policy.MaxAge.String()).
+			Info("[janitor] Pruned %d messages\n", total)
+	}
+}
+
+// Ping checks that the Run loop is alive.
+func (j *Janitor) Ping(timeout time.Duration) error {
+	reply := make(chan struct{})
+	select {
+	case j.ping <- reply:
+	case <-time.After(timeout):
+		return JanitorNotRunning
+	}
+
+	select {
+	case <-reply:
+		return nil
+	case <-time.After(timeout):
+		return JanitorNotRunning
+	}
+}
+
+func createdBefore(maxAge time.Duration) int {
+	if maxAge == 0 {
+		return 0
+	}
+
+	return int(time.Now().Add(-maxAge).Unix())
+}
@@ -0,0 +1,16 @@
+package janitor
+
+import "github.com/mazanax/go-chat/app/metrics"
+
+var (
+	prunedMessages = metrics.NewCounterVec(
+		"chat_retention_pruned_messages_total",
+		"Messages deleted by the retention janitor, by the limit they exceeded.",
+		"reason",
+	)
+	runDuration = metrics.NewHistogram(
+		"chat_retention_run_duration_seconds",
+		"Time taken by a pass of the retention janitor.",
+		metrics.DefaultBuckets,
+	)
+)
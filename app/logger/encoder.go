@@ -0,0 +1,96 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encoder serializes a single entry, including the trailing newline.
+type Encoder interface {
+	Encode(w io.Writer, entry Entry) error
+}
+
+// NewEncoder returns the encoder for the LOG_FORMAT value: "json" or "text".
+func NewEncoder(format string) (Encoder, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "text":
+		return TextEncoder{}, nil
+	case "json":
+		return JSONEncoder{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// TextEncoder writes human-readable lines: time, level, message and then key=value pairs.
+type TextEncoder struct{}
+
+func (TextEncoder) Encode(w io.Writer, entry Entry) error {
+	var buf bytes.Buffer
+	buf.WriteString(entry.Time.Format(time.RFC3339))
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToUpper(entry.Level.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(entry.Message)
+
+	for _, field := range entry.Fields {
+		buf.WriteByte(' ')
+		buf.WriteString(field.Key)
+		buf.WriteByte('=')
+
+		value := fmt.Sprint(field.Value)
+		if err, ok := field.Value.(error); ok {
+			value = err.Error()
+		}
+		if strings.ContainsAny(value, " \t\r\n\"=") || len(value) == 0 {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// JSONEncoder writes one JSON object per line.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(w io.Writer, entry Entry) error {
+	var buf bytes.Buffer
+	buf.WriteString(`{"ts":`)
+	writeJSON(&buf, entry.Time.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, entry.Level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, entry.Message)
+
+	for _, field := range entry.Fields {
+		buf.WriteByte(',')
+		writeJSON(&buf, field.Key)
+		buf.WriteByte(':')
+
+		value := field.Value
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJSON(&buf, value)
+	}
+	buf.WriteString("}\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(encoded)
+}
@@ -4,40 +4,209 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
-var debugOutput io.Writer
-var errorOutput io.Writer
+type Level int
 
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func (level Level) String() string {
+	return levelNames[level]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(strings.TrimSpace(name), levelName) {
+			return level, nil
+		}
+	}
+
+	return InfoLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+// Field is a single key-value pair attached to an entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// Logger writes leveled entries enriched with its fields. The zero value is ready to use.
+type Logger struct {
+	fields []Field
+}
+
+var (
+	mu          sync.Mutex
+	minLevel    Level   = InfoLevel
+	encoder     Encoder = TextEncoder{}
+	debugOutput io.Writer
+	errorOutput io.Writer
+
+	// "[http] Request URL" style prefixes are turned into the component field
+	componentPattern = regexp.MustCompile(`^\[([^\]]+)\]\s*`)
+
+	std = &Logger{}
+)
+
+// SetDebugOutputFile sets the writer for debug and info entries.
 func SetDebugOutputFile(file io.Writer) {
+	mu.Lock()
 	debugOutput = file
+	mu.Unlock()
 }
 
+// SetErrorOutputFile sets the writer for warn and error entries.
 func SetErrorOutputFile(file io.Writer) {
+	mu.Lock()
 	errorOutput = file
+	mu.Unlock()
 }
 
-func Debug(message string, arguments ...interface{}) {
-	if debugOutput == nil {
-		debugOutput = os.Stdout
-	}
+func SetLevel(level Level) {
+	mu.Lock()
+	minLevel = level
+	mu.Unlock()
+}
 
-	_, _ = fmt.Fprintf(debugOutput, message, arguments...)
+func SetEncoder(enc Encoder) {
+	mu.Lock()
+	encoder = enc
+	mu.Unlock()
 }
 
-func Error(message string, arguments ...interface{}) {
-	if errorOutput == nil {
-		errorOutput = os.Stderr
+// With returns a logger which attaches the given key-value pairs to every entry.
+func With(keysAndValues ...interface{}) *Logger {
+	return std.With(keysAndValues...)
+}
+
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := make([]Field, len(l.fields), len(l.fields)+len(keysAndValues)/2)
+	copy(fields, l.fields)
+
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		var value interface{} = "<missing>"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fields = append(fields, Field{Key: key, Value: value})
 	}
 
-	_, _ = fmt.Fprintf(errorOutput, message, arguments...)
+	return &Logger{fields: fields}
 }
 
-func Fatal(message string, arguments ...interface{}) {
-	if errorOutput != nil {
-		errorOutput = os.Stderr
-	}
+func (l *Logger) Debug(message string, arguments ...interface{}) {
+	l.log(DebugLevel, message, arguments)
+}
+
+func (l *Logger) Info(message string, arguments ...interface{}) {
+	l.log(InfoLevel, message, arguments)
+}
+
+func (l *Logger) Warn(message string, arguments ...interface{}) {
+	l.log(WarnLevel, message, arguments)
+}
 
-	_, _ = fmt.Fprintf(errorOutput, message, arguments...)
+func (l *Logger) Error(message string, arguments ...interface{}) {
+	l.log(ErrorLevel, message, arguments)
+}
+
+// Fatal writes an error entry regardless of the configured level and exits the process.
+func (l *Logger) Fatal(message string, arguments ...interface{}) {
+	l.write(ErrorLevel, message, arguments)
 	os.Exit(1)
 }
+
+func (l *Logger) log(level Level, message string, arguments []interface{}) {
+	mu.Lock()
+	enabled := level >= minLevel
+	mu.Unlock()
+
+	if enabled {
+		l.write(level, message, arguments)
+	}
+}
+
+func (l *Logger) write(level Level, message string, arguments []interface{}) {
+	if len(arguments) > 0 {
+		message = fmt.Sprintf(message, arguments...)
+	}
+	message = strings.TrimRight(message, "\r\n")
+
+	fields := make([]Field, 0, len(l.fields)+1)
+	if match := componentPattern.FindStringSubmatch(message); match != nil {
+		fields = append(fields, Field{Key: "component", Value: match[1]})
+		message = message[len(match[0]):]
+	}
+	for _, field := range l.fields {
+		fields = append(fields, Field{Key: field.Key, Value: redactField(field.Key, field.Value)})
+	}
+
+	entry := Entry{
+		Time:    time.Now().UTC(),
+		Level:   level,
+		Message: redactText(message),
+		Fields:  fields,
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	output := debugOutput
+	if output == nil {
+		output = os.Stdout
+	}
+	if level >= WarnLevel {
+		output = errorOutput
+		if output == nil {
+			output = os.Stderr
+		}
+	}
+
+	if err := encoder.Encode(output, entry); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "logger: cannot encode entry: %s\n", err)
+	}
+}
+
+func Debug(message string, arguments ...interface{}) {
+	std.log(DebugLevel, message, arguments)
+}
+
+func Info(message string, arguments ...interface{}) {
+	std.log(InfoLevel, message, arguments)
+}
+
+func Warn(message string, arguments ...interface{}) {
+	std.log(WarnLevel, message, arguments)
+}
+
+func Error(message string, arguments ...interface{}) {
+	std.log(ErrorLevel, message, arguments)
+}
+
+func Fatal(message string, arguments ...interface{}) {
+	std.Fatal(message, arguments...)
+}
@@ -0,0 +1,35 @@
+package logger
+
+import (
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	// field names whose values are never written as is
+	secretKeys = []string{"token", "password", "code", "secret", "ticket", "authorization"}
+
+	// access tokens, tickets and reset codes are long hex strings, see tokens.randomHexString
+	secretPattern = regexp.MustCompile(`\b[0-9a-fA-F]{32,}\b`)
+)
+
+func redactField(key string, value interface{}) interface{} {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return redacted
+		}
+	}
+
+	if text, ok := value.(string); ok {
+		return redactText(text)
+	}
+
+	return value
+}
+
+func redactText(text string) string {
+	return secretPattern.ReplaceAllString(text, redacted)
+}
@@ -1,115 +1,307 @@
 package mailer
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
+	"github.com/mazanax/go-chat/app/db"
 	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/models"
+	"math/rand"
 	"net/mail"
-	"net/smtp"
+	"net/textproto"
 	"strings"
+	"sync"
+	"time"
 )
 
-type Mail struct {
-	to      string
-	message []byte
+const (
+	// how often the outbox is checked for mails whose retry is due
+	pollInterval = time.Second
+	// a claimed mail becomes visible again after this period if the sender died while sending it, or after a
+	// longer one if sending may take longer, see leaseFor
+	minClaimLease = 5 * time.Minute
+)
+
+var MailerNotRunning = fmt.Errorf("mailer is not running")
+
+type Config struct {
+	Sender string
+	// display name in the From header
+	FromName  string
+	Transport TransportConfig
+
+	// number of mails sent in parallel, every worker keeps its own SMTP connection
+	Workers int
+	// limit for a single delivery, including connecting to the server
+	SendTimeout time.Duration
+
+	// a mail is moved to the dead-letter set after this many failed attempts
+	MaxAttempts int
+	// delay before the first retry, doubled on every next one up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
 }
 
 type Mailer struct {
-	sender string
-	host   string
-	port   int
-	auth   smtp.Auth
-	queue  chan Mail
-}
+	sender    string
+	fromName  string
+	transport Transport
+	templates *Templates
+
+	outbox          db.MailOutboxRepository
+	workers         int
+	sendTimeout     time.Duration
+	claimLease      time.Duration
+	maxAttempts     int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
 
-func New(authLogin string, senderMail string, senderPassword string, smtpHost string, smtpPort int) Mailer {
-	auth := smtp.PlainAuth("", authLogin, senderPassword, smtpHost)
+	// Enqueue wakes Run up so fresh mails do not wait for the next poll
+	wakeup chan struct{}
+	// liveness probes, Run closes every received channel
+	ping chan chan struct{}
+}
 
+func New(config Config, transport Transport, templates *Templates, outbox db.MailOutboxRepository) Mailer {
 	return Mailer{
-		auth:   auth,
-		host:   smtpHost,
-		sender: senderMail,
-		port:   smtpPort,
+		sender:    strings.Trim(config.Sender, "\n\r"),
+		fromName:  config.FromName,
+		transport: transport,
+		templates: templates,
+
+		outbox:          outbox,
+		workers:         config.Workers,
+		sendTimeout:     config.SendTimeout,
+		claimLease:      leaseFor(config.SendTimeout),
+		maxAttempts:     config.MaxAttempts,
+		retryBackoff:    config.RetryBackoff,
+		maxRetryBackoff: config.MaxRetryBackoff,
 
-		queue: make(chan Mail, 256),
+		wakeup: make(chan struct{}, 1),
+		ping:   make(chan chan struct{}),
 	}
 }
 
-func (mailer *Mailer) Run() {
+// Run delivers the outbox with a pool of workers until the context is cancelled. Mails being sent when that
+// happens are finished, claimed mails which were not handed to a worker yet go back to the outbox.
+func (mailer *Mailer) Run(ctx context.Context) {
+	jobs := make(chan models.Mail)
+	var wg sync.WaitGroup
+	for i := 0; i < mailer.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for message := range jobs {
+				mailer.deliver(message)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+		if err := mailer.transport.Close(); err != nil {
+			logger.Error("[mailer] Cannot close transport: %s\n", err)
+		}
+		logger.Info("[mailer] Stopped\n")
+	}()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	if !mailer.dispatchDue(ctx, jobs) {
+		return
+	}
 	for {
 		select {
-		case message := <-mailer.queue:
-			logger.Debug("[mailer] Got message for %s: %s\n", message.to, message.message)
+		case <-ctx.Done():
+			return
+		case reply := <-mailer.ping:
+			// probes do no work, or the probe rate would set how often the outbox is polled
+			close(reply)
+			continue
+		case <-mailer.wakeup:
+		case <-ticker.C:
+		}
 
-			sender := strings.Trim(mailer.sender, "\n\r")
+		if !mailer.dispatchDue(ctx, jobs) {
+			return
+		}
+	}
+}
 
-			client := mailer.getClient()
-			if client == nil {
-				logger.Error("[mailer] Cannot create client\n")
-				continue
-			}
+// dispatchDue hands all due mails to the workers, it returns false when the context is cancelled.
+func (mailer *Mailer) dispatchDue(ctx context.Context, jobs chan<- models.Mail) bool {
+	for {
+		// claiming no more than there are workers keeps the other mails available to other nodes
+		mails, err := mailer.outbox.ClaimDueMails(mailer.workers, mailer.claimLease)
+		if err != nil {
+			logger.Error("[mailer] Cannot claim mails from the outbox: %s\n", err)
+			return true
+		}
 
-			if err := client.Auth(mailer.auth); err != nil {
-				logger.Error("[mailer] Auth error: %s\n", err)
-				continue
+		for i := 0; i < len(mails); {
+			select {
+			case jobs <- mails[i]:
+				i++
+			case reply := <-mailer.ping:
+				// waiting for busy workers is not being stuck
+				close(reply)
+			case <-ctx.Done():
+				mailer.release(mails[i:])
+				return false
 			}
+		}
 
-			if err := client.Mail(sender); err != nil {
-				logger.Error("[mailer] Cannot set sender: %s\n", err)
-				continue
-			}
+		if size, err := mailer.outbox.OutboxSize(); err == nil {
+			queueDepth.Set(float64(size))
+		}
 
-			if err := client.Rcpt(message.to); err != nil {
-				logger.Error("[mailer] Cannot set recipient: %s\n", err)
-				continue
-			}
+		if len(mails) < mailer.workers {
+			return true
+		}
+	}
+}
 
-			w, err := client.Data()
-			if err != nil {
-				logger.Error("[mailer] Cannot get writer: %s\n", err)
-				continue
-			}
+// leaseFor returns the claim lease for the send timeout. A claimed mail waits for a free worker, at most one
+// send, and is then sent; the lease outlasts both, so that nobody claims a mail which is still being sent.
+func leaseFor(sendTimeout time.Duration) time.Duration {
+	lease := 2*sendTimeout + time.Minute
+	if lease < minClaimLease {
+		return minClaimLease
+	}
 
-			if _, err := w.Write(message.message); err != nil {
-				logger.Error("[mailer] Cannot write message: %s\n", err)
-				_ = w.Close()
-				continue
-			}
+	return lease
+}
 
-			_ = w.Close()
-			_ = client.Quit()
-			logger.Debug("[mailer] Sent message %#v\n", message)
-		default: // nothing
+func (mailer *Mailer) release(mails []models.Mail) {
+	for _, message := range mails {
+		if err := mailer.outbox.RetryMail(message, time.Now()); err != nil {
+			logger.With("mail_id", message.ID).Error("[mailer] Cannot return mail to the outbox: %s\n", err)
 		}
 	}
 }
 
-func (mailer *Mailer) getClient() *smtp.Client {
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         mailer.host,
+func (mailer *Mailer) deliver(message models.Mail) {
+	log := logger.With("mail_id", message.ID, "to", message.To, "attempt", message.Attempts+1)
+	log.Debug("[mailer] Got message\n")
+
+	// a shutdown must not cut a mail in the middle, so only the timeout applies to the delivery itself
+	sendCtx, cancel := context.WithTimeout(context.Background(), mailer.sendTimeout)
+	err := mailer.transport.Send(sendCtx, mailer.sender, message.To, []byte(message.Message))
+	cancel()
+	if err == nil {
+		mailsSent.Inc()
+		log.Info("[mailer] Sent message\n")
+		if err := mailer.outbox.MarkMailSent(message); err != nil {
+			log.Error("[mailer] Cannot remove sent message from the outbox: %s\n", err)
+		}
+		return
 	}
 
-	conn, err := tls.Dial("tcp", fmt.Sprintf("%s:%d", mailer.host, mailer.port), tlsConfig)
-	if err != nil {
+	message.Attempts++
+	message.LastError = err.Error()
+	if isPermanent(err) || message.Attempts >= mailer.maxAttempts {
+		log.Error("[mailer] Giving up on message: %s\n", err)
+		deadLettered.Inc()
+		if err := mailer.outbox.DeadLetterMail(message); err != nil {
+			log.Error("[mailer] Cannot dead-letter message: %s\n", err)
+		}
+		return
+	}
+
+	delay := mailer.backoff(message.Attempts)
+	log.Warn("[mailer] Cannot send message, retrying in %s: %s\n", delay, err)
+	if err := mailer.outbox.RetryMail(message, time.Now().Add(delay)); err != nil {
+		log.Error("[mailer] Cannot schedule retry: %s\n", err)
+	}
+}
+
+// backoff returns the exponential delay before the given retry, with up to 20% of jitter so that mails
+// which failed together do not retry together.
+func (mailer *Mailer) backoff(attempt int) time.Duration {
+	delay := mailer.retryBackoff
+	for i := 1; i < attempt && delay < mailer.maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > mailer.maxRetryBackoff {
+		delay = mailer.maxRetryBackoff
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// isPermanent reports 5xx SMTP replies: the server will not accept the mail no matter how often it is retried.
+func isPermanent(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
+
+// Ping checks that the Run loop is alive. It is answered while the loop waits for a free worker too, so slow
+// deliveries do not fail it.
+func (mailer *Mailer) Ping(timeout time.Duration) error {
+	reply := make(chan struct{})
+	select {
+	case mailer.ping <- reply:
+	case <-time.After(timeout):
+		return MailerNotRunning
+	}
+
+	select {
+	case <-reply:
 		return nil
+	case <-time.After(timeout):
+		return MailerNotRunning
+	}
+}
+
+// EnqueueTemplate renders the named template in the recipient's locale and stores the mail in the outbox.
+func (mailer *Mailer) EnqueueTemplate(name string, locale string, to mail.Address, data interface{}) error {
+	message, err := mailer.Render(name, locale, to, data)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Enqueue(message)
+}
+
+// Render builds the message from the named template without sending it, so that headers can be added.
+func (mailer *Mailer) Render(name string, locale string, to mail.Address, data interface{}) (Message, error) {
+	message, err := mailer.templates.Render(name, locale, to.Address, data)
+	if err != nil {
+		return Message{}, fmt.Errorf("cannot render %s mail: %w", name, err)
 	}
+	message.ToName = to.Name
 
-	client, _ := smtp.NewClient(conn, mailer.host)
-	return client
+	return message, nil
 }
 
-func (mailer *Mailer) Enqueue(email string, message string, subject string) {
-	from := mail.Address{Name: "MZNX Chat", Address: mailer.sender}
-	to := mail.Address{Name: "", Address: email}
+// Enqueue stores the mail in the outbox, it is sent by Run.
+func (mailer *Mailer) Enqueue(message Message) error {
+	from := mail.Address{Name: mailer.fromName, Address: mailer.sender}
+	encoded, err := encode(from, message, time.Now())
+	if err != nil {
+		return err
+	}
+
+	now := int(time.Now().Unix())
+	err = mailer.outbox.EnqueueMail(models.Mail{
+		ID:            uuid.NewString(),
+		To:            message.To,
+		Subject:       message.Subject,
+		Message:       string(encoded),
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	})
+	if err != nil {
+		return err
+	}
 
-	msg := fmt.Sprintf("From: %s\r\n", from.String()) +
-		fmt.Sprintf("To: %s\r\n", to.String()) +
-		fmt.Sprintf("Subject: %s\r\n", subject) +
-		"MIME-version: 1.0;\r\n" +
-		"Content-Type: text/html; charset=\"UTF-8\";\r\n" +
-		"\r\n" +
-		message + "\r\n"
+	select {
+	case mailer.wakeup <- struct{}{}:
+	default: // Run is already woken up
+	}
 
-	mailer.queue <- Mail{to: email, message: []byte(msg)}
+	return nil
 }
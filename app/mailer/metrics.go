@@ -0,0 +1,23 @@
+package mailer
+
+import "github.com/mazanax/go-chat/app/metrics"
+
+var (
+	queueDepth = metrics.NewGauge(
+		"chat_mailer_queue_depth",
+		"Emails waiting in the outbox, including scheduled retries.",
+	)
+	mailsSent = metrics.NewCounter(
+		"chat_mailer_sent_total",
+		"Emails handed over to the SMTP server.",
+	)
+	deadLettered = metrics.NewCounter(
+		"chat_mailer_dead_lettered_total",
+		"Emails moved to the dead-letter set after failing permanently.",
+	)
+	sendFailures = metrics.NewCounterVec(
+		"chat_mailer_send_failures_total",
+		"Emails that could not be sent, by failed stage.",
+		"stage",
+	)
+)
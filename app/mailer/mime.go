@@ -0,0 +1,123 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is an email before it is encoded. At least one of Text and HTML must be set.
+type Message struct {
+	To     string
+	ToName string
+	// not encoded yet, any UTF-8 is fine
+	Subject string
+	Text    string
+	HTML    string
+	// extra headers, e.g. List-Unsubscribe; values must be ASCII
+	Headers map[string]string
+}
+
+type mimePart struct {
+	contentType string
+	body        string
+}
+
+// encode renders the message according to RFC 5322 and RFC 2045-2047: the subject and the display names
+// are encoded words, and the bodies are quoted-printable parts of a multipart/alternative.
+func encode(from mail.Address, message Message, now time.Time) ([]byte, error) {
+	to := mail.Address{Name: message.ToName, Address: message.To}
+
+	var buf bytes.Buffer
+	header := func(name string, value string) {
+		_, _ = fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+	header("From", from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", uuid.NewString(), messageIDDomain(from.Address)))
+	header("MIME-Version", "1.0")
+	names := make([]string, 0, len(message.Headers))
+	for name := range message.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header(textproto.CanonicalMIMEHeaderKey(name), message.Headers[name])
+	}
+
+	parts := make([]mimePart, 0, 2)
+	// the last alternative is the preferred one
+	if len(message.Text) > 0 {
+		parts = append(parts, mimePart{contentType: "text/plain; charset=utf-8", body: message.Text})
+	}
+	if len(message.HTML) > 0 {
+		parts = append(parts, mimePart{contentType: "text/html; charset=utf-8", body: message.HTML})
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("message has no body")
+	}
+
+	if len(parts) == 1 {
+		header("Content-Type", parts[0].contentType)
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, parts[0].body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	header("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": writer.Boundary()}))
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	// SMTP expects CRLF line endings
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+
+	return qp.Close()
+}
+
+func messageIDDomain(address string) string {
+	if at := strings.LastIndex(address, "@"); at >= 0 && at < len(address)-1 {
+		return address[at+1:]
+	}
+
+	return "localhost"
+}
@@ -1,23 +1,147 @@
 package mailer
 
 import (
+	"bytes"
 	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
 )
 
-func PasswordRecoveryEmail(username string, email string, link string) string {
-	return fmt.Sprintf(`<p>Dear, %s!</p>
+// Names of the templates shipped in templates/mail.
+const (
+	PasswordRecoveryTemplate   = "password_recovery"
+	NotificationDigestTemplate = "notification_digest"
+)
+
+// Brand is available in every template as .Brand.
+type Brand struct {
+	Name string
+	URL  string
+}
+
+// Templates holds email templates loaded from a directory laid out as <dir>/<locale>/<name>.<part>, where
+// the parts are subject.txt, txt and html. The html part is rendered by html/template, so every value is
+// escaped for its context.
+type Templates struct {
+	brand         Brand
+	defaultLocale string
+	subjects      map[string]*texttemplate.Template
+	texts         map[string]*texttemplate.Template
+	htmls         map[string]*htmltemplate.Template
+}
+
+func LoadTemplates(dir string, defaultLocale string, brand Brand) (*Templates, error) {
+	templates := &Templates{
+		brand:         brand,
+		defaultLocale: defaultLocale,
+		subjects:      make(map[string]*texttemplate.Template),
+		texts:         make(map[string]*texttemplate.Template),
+		htmls:         make(map[string]*htmltemplate.Template),
+	}
+
+	locales, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read templates directory: %w", err)
+	}
+
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+
+		files, err := filepath.Glob(filepath.Join(dir, locale.Name(), "*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if err := templates.load(locale.Name(), file); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return templates, nil
+}
+
+func (templates *Templates) load(locale string, file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Base(file)
+	switch {
+	case strings.HasSuffix(base, ".subject.txt"):
+		key := templateKey(locale, strings.TrimSuffix(base, ".subject.txt"))
+		templates.subjects[key], err = texttemplate.New(base).Option("missingkey=error").Parse(string(content))
+	case strings.HasSuffix(base, ".txt"):
+		key := templateKey(locale, strings.TrimSuffix(base, ".txt"))
+		templates.texts[key], err = texttemplate.New(base).Option("missingkey=error").Parse(string(content))
+	case strings.HasSuffix(base, ".html"):
+		key := templateKey(locale, strings.TrimSuffix(base, ".html"))
+		templates.htmls[key], err = htmltemplate.New(base).Option("missingkey=error").Parse(string(content))
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("cannot parse template %s: %w", file, err)
+	}
+
+	return nil
+}
+
+// Render builds the message from the template variant for the locale, falling back to the default locale.
+// The data is available in templates as .Data.
+func (templates *Templates) Render(name string, locale string, to string, data interface{}) (Message, error) {
+	key := templateKey(locale, name)
+	if _, ok := templates.subjects[key]; !ok {
+		key = templateKey(templates.defaultLocale, name)
+	}
+
+	subject, ok := templates.subjects[key]
+	if !ok {
+		return Message{}, fmt.Errorf("template %s not found", name)
+	}
 
-<p>Somebody requested a new password for the <a href="https://chat.mznx.ru/">chat.mznx.ru</a> account associated with %s.</p>
+	variables := map[string]interface{}{
+		"Brand": templates.brand,
+		"Data":  data,
+	}
+	message := Message{To: to}
 
-<p><b>No changes have been made to your account yet.</b></p>
+	var buf bytes.Buffer
+	if err := subject.Execute(&buf, variables); err != nil {
+		return Message{}, err
+	}
+	message.Subject = strings.TrimSpace(buf.String())
 
-<p>You can reset your password by clicking the link below:<br>
-<a href="%s">%s</a></p>
+	if text, ok := templates.texts[key]; ok {
+		buf.Reset()
+		if err := text.Execute(&buf, variables); err != nil {
+			return Message{}, err
+		}
+		message.Text = buf.String()
+	}
 
-<p>This password reset link is only valid for the <b>next 5 minutes</b>.</p>
+	if html, ok := templates.htmls[key]; ok {
+		buf.Reset()
+		if err := html.Execute(&buf, variables); err != nil {
+			return Message{}, err
+		}
+		message.HTML = buf.String()
+	}
 
-<p>If you did not request a new password, please let us know immediately by replying to this email.</p>
+	if len(message.Text) == 0 && len(message.HTML) == 0 {
+		return Message{}, fmt.Errorf("template %s has no body", name)
+	}
+
+	return message, nil
+}
 
-<p>Yours,<br>
-The chat.mznx.ru team</p>`, username, email, link, link)
+func templateKey(locale string, name string) string {
+	return strings.ToLower(locale) + "/" + name
 }
@@ -0,0 +1,325 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/mazanax/go-chat/app/logger"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TransportTLS      = "tls"
+	TransportStartTLS = "starttls"
+	TransportPlain    = "plain"
+	TransportFile     = "file"
+	TransportLog      = "log"
+)
+
+// Transport delivers rendered messages. Send is called concurrently by the mailer workers and must give up
+// once the context is done.
+type Transport interface {
+	Send(ctx context.Context, from string, to string, message []byte) error
+	Close() error
+}
+
+type TransportConfig struct {
+	// one of the Transport* constants
+	Kind     string
+	Login    string
+	Password string
+	SmtpHost string
+	SmtpPort int
+	// only meant for servers with self-signed certificates in development
+	TLSSkipVerify bool
+	// maildir used by the file transport
+	Dir string
+}
+
+func NewTransport(config TransportConfig) (Transport, error) {
+	switch config.Kind {
+	case TransportTLS, TransportStartTLS, TransportPlain:
+		return newSmtpTransport(config), nil
+	case TransportFile:
+		return newFileTransport(config.Dir)
+	case TransportLog:
+		return &logTransport{output: os.Stdout}, nil
+	}
+
+	return nil, fmt.Errorf("unknown mail transport %q", config.Kind)
+}
+
+// region SMTP
+
+// idle connections older than this are not reused, servers usually drop them after a minute or so
+const smtpIdleTimeout = 30 * time.Second
+
+type smtpConn struct {
+	conn   net.Conn
+	client *smtp.Client
+	usedAt time.Time
+}
+
+func (c *smtpConn) close() {
+	_ = c.client.Close()
+}
+
+// smtpTransport keeps connections open between messages. Every concurrent Send uses its own connection,
+// which is put back to the idle list once the message is accepted.
+type smtpTransport struct {
+	kind      string
+	addr      string
+	host      string
+	auth      smtp.Auth
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	idle []*smtpConn
+}
+
+func newSmtpTransport(config TransportConfig) *smtpTransport {
+	transport := &smtpTransport{
+		kind: config.Kind,
+		addr: net.JoinHostPort(config.SmtpHost, strconv.Itoa(config.SmtpPort)),
+		host: config.SmtpHost,
+		tlsConfig: &tls.Config{
+			ServerName:         config.SmtpHost,
+			InsecureSkipVerify: config.TLSSkipVerify,
+		},
+	}
+	// the local relay accepts mail without authentication
+	if config.Kind != TransportPlain && len(config.Login) > 0 {
+		transport.auth = smtp.PlainAuth("", config.Login, config.Password, config.SmtpHost)
+	}
+
+	return transport
+}
+
+func (transport *smtpTransport) Send(ctx context.Context, from string, to string, message []byte) error {
+	c, err := transport.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetDeadline(deadline)
+	}
+
+	if err := transport.send(c.client, from, to, message); err != nil {
+		// the state of the session is unknown, it is cheaper to open a new one than to recover it
+		c.close()
+		return err
+	}
+
+	_ = c.conn.SetDeadline(time.Time{})
+	c.usedAt = time.Now()
+
+	transport.mu.Lock()
+	transport.idle = append(transport.idle, c)
+	transport.mu.Unlock()
+
+	return nil
+}
+
+func (transport *smtpTransport) send(client *smtp.Client, from string, to string, message []byte) error {
+	if err := client.Mail(from); err != nil {
+		sendFailures.WithLabelValues("sender").Inc()
+		return fmt.Errorf("cannot set sender: %w", err)
+	}
+
+	if err := client.Rcpt(to); err != nil {
+		sendFailures.WithLabelValues("recipient").Inc()
+		return fmt.Errorf("cannot set recipient: %w", err)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		sendFailures.WithLabelValues("data").Inc()
+		return fmt.Errorf("cannot get writer: %w", err)
+	}
+
+	if _, err := w.Write(message); err != nil {
+		_ = w.Close()
+		sendFailures.WithLabelValues("data").Inc()
+		return fmt.Errorf("cannot write message: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		sendFailures.WithLabelValues("data").Inc()
+		return fmt.Errorf("message rejected: %w", err)
+	}
+
+	return nil
+}
+
+// acquire returns an idle connection which is still alive, or opens a new one.
+func (transport *smtpTransport) acquire(ctx context.Context) (*smtpConn, error) {
+	for {
+		transport.mu.Lock()
+		if len(transport.idle) == 0 {
+			transport.mu.Unlock()
+			break
+		}
+		c := transport.idle[len(transport.idle)-1]
+		transport.idle = transport.idle[:len(transport.idle)-1]
+		transport.mu.Unlock()
+
+		if time.Since(c.usedAt) > smtpIdleTimeout {
+			c.close()
+			continue
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = c.conn.SetDeadline(deadline)
+		}
+		if err := c.client.Reset(); err != nil {
+			c.close()
+			continue
+		}
+
+		return c, nil
+	}
+
+	c, err := transport.dial(ctx)
+	if err != nil {
+		sendFailures.WithLabelValues("connect").Inc()
+		return nil, fmt.Errorf("cannot create client: %w", err)
+	}
+
+	if transport.auth != nil {
+		if err := c.client.Auth(transport.auth); err != nil {
+			c.close()
+			sendFailures.WithLabelValues("auth").Inc()
+			return nil, fmt.Errorf("auth error: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (transport *smtpTransport) dial(ctx context.Context) (*smtpConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", transport.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if transport.kind == TransportTLS {
+		tlsConn := tls.Client(conn, transport.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	client, err := smtp.NewClient(conn, transport.host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if transport.kind == TransportStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			_ = client.Close()
+			return nil, fmt.Errorf("%s does not support STARTTLS", transport.addr)
+		}
+
+		if err := client.StartTLS(transport.tlsConfig); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+
+	return &smtpConn{conn: conn, client: client, usedAt: time.Now()}, nil
+}
+
+// Close says goodbye to the server on every idle connection.
+func (transport *smtpTransport) Close() error {
+	transport.mu.Lock()
+	idle := transport.idle
+	transport.idle = nil
+	transport.mu.Unlock()
+
+	for _, c := range idle {
+		_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_ = c.client.Quit()
+	}
+
+	return nil
+}
+
+// endregion
+
+// region File
+
+// fileTransport stores every message in a maildir, which mail clients and tests can read.
+type fileTransport struct {
+	dir string
+}
+
+func newFileTransport(dir string) (*fileTransport, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("cannot create maildir: %w", err)
+		}
+	}
+
+	return &fileTransport{dir: dir}, nil
+}
+
+func (transport *fileTransport) Send(_ context.Context, _ string, _ string, message []byte) error {
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), uuid.NewString(), hostname)
+
+	// maildir delivery: write to tmp and move to new, so readers never see a partial message
+	tmp := filepath.Join(transport.dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, message, 0o644); err != nil {
+		sendFailures.WithLabelValues("data").Inc()
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(transport.dir, "new", name))
+}
+
+func (transport *fileTransport) Close() error {
+	return nil
+}
+
+// endregion
+
+// region Log
+
+// logTransport prints messages instead of sending them, for development.
+type logTransport struct {
+	mu     sync.Mutex
+	output io.Writer
+}
+
+func (transport *logTransport) Send(_ context.Context, from string, to string, message []byte) error {
+	logger.With("from", from, "to", to).Info("[mailer] Message is printed by the log transport\n")
+
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+
+	_, err := fmt.Fprintf(transport.output, "----- mail from %s to %s -----\n%s\n----- end of mail -----\n", from, to, message)
+	return err
+}
+
+func (transport *logTransport) Close() error {
+	return nil
+}
+
+// endregion
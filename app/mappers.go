@@ -1,6 +1,11 @@
 package app
 
-import "github.com/mazanax/go-chat/app/models"
+import (
+	"fmt"
+	"github.com/mazanax/go-chat/app/models"
+	"strconv"
+	"time"
+)
 
 func mapUserToJson(user models.User, withEmail bool) models.JsonUser {
 	email := user.Email
@@ -8,14 +13,28 @@ func mapUserToJson(user models.User, withEmail bool) models.JsonUser {
 		email = ""
 	}
 
-	return models.JsonUser{
+	jsonUser := models.JsonUser{
 		ID:        user.ID,
 		Name:      user.Name,
 		Email:     email,
 		Username:  user.Username,
 		CreatedAt: user.CreatedAt,
 		UpdatedAt: user.UpdatedAt,
+
+		Bio:      user.Bio,
+		Status:   user.Status,
+		Timezone: user.Timezone,
+		Pronouns: user.Pronouns,
+	}
+	if user.AvatarVersion > 0 {
+		jsonUser.Avatar = make(map[string]string, len(avatarSizes))
+		for _, size := range avatarSizes {
+			// the version changes the URL, so the avatars can be cached for long
+			jsonUser.Avatar[strconv.Itoa(size)] = fmt.Sprintf("/api/avatars/%s/%d?v=%d", user.ID, size, user.AvatarVersion)
+		}
 	}
+
+	return jsonUser
 }
 
 func mapAccessTokenToJson(token models.AccessToken) models.JsonAccessToken {
@@ -36,10 +55,62 @@ func mapTicketToJson(ticket models.Ticket) models.JsonTicket {
 
 func mapMessageToJson(message models.Message) models.JsonMessage {
 	return models.JsonMessage{
-		ID:        message.ID,
-		UserID:    message.UserID,
-		Type:      message.Type,
-		CreatedAt: message.CreatedAt,
-		Text:      message.Text,
+		ID:          message.ID,
+		UserID:      message.UserID,
+		Type:        message.Type,
+		CreatedAt:   message.CreatedAt,
+		Text:        message.Text,
+		HTML:        message.HTML,
+		AST:         models.MapMarkupToJson(message.Markup),
+		Mentions:    message.Mentions,
+		Attachments: models.MapUploadsToJson(message.Attachments),
+		Previews:    models.MapPreviewsToJson(message.Previews),
+	}
+}
+
+func mapMailToJson(mail models.Mail) models.JsonMail {
+	return models.JsonMail{
+		ID:            mail.ID,
+		To:            mail.To,
+		Subject:       mail.Subject,
+		Attempts:      mail.Attempts,
+		LastError:     mail.LastError,
+		CreatedAt:     mail.CreatedAt,
+		NextAttemptAt: mail.NextAttemptAt,
+	}
+}
+
+func mapAuditEventToJson(event models.AuditEvent) models.JsonAuditEvent {
+	return models.JsonAuditEvent{
+		ID:        event.ID,
+		Type:      event.Type,
+		ActorID:   event.ActorID,
+		TargetID:  event.TargetID,
+		IP:        event.IP,
+		CreatedAt: event.CreatedAt,
+		Data:      event.Data,
+	}
+}
+
+func mapRetentionPolicyToJson(policy models.RetentionPolicy, overridden bool) models.JsonRetentionPolicy {
+	return models.JsonRetentionPolicy{
+		MaxAge:     int(policy.MaxAge / time.Second),
+		MaxCount:   policy.MaxCount,
+		Overridden: overridden,
+	}
+}
+
+func mapTopicToJson(topic models.Topic) models.JsonTopic {
+	return models.JsonTopic{
+		Text:      topic.Text,
+		UserID:    topic.UserID,
+		UpdatedAt: topic.UpdatedAt,
+	}
+}
+
+func mapNotificationPreferencesToJson(preferences models.NotificationPreferences) models.JsonNotificationPreferences {
+	return models.JsonNotificationPreferences{
+		Mentions:       preferences.Mentions,
+		DirectMessages: preferences.DirectMessages,
 	}
 }
@@ -0,0 +1,54 @@
+package markdown
+
+import (
+	"html"
+	"strings"
+)
+
+// RenderHTML returns the HTML of the nodes returned by Parse. All text is escaped, the only tags are the ones
+// written here, and links open in a new tab without passing the referrer or ranking the target.
+func RenderHTML(nodes []Node) string {
+	var b strings.Builder
+	render(&b, nodes)
+
+	return b.String()
+}
+
+func render(b *strings.Builder, nodes []Node) {
+	for _, node := range nodes {
+		switch node.Type {
+		case Paragraph:
+			b.WriteString("<p>")
+			render(b, node.Children)
+			b.WriteString("</p>")
+		case Quote:
+			b.WriteString("<blockquote>")
+			render(b, node.Children)
+			b.WriteString("</blockquote>")
+		case CodeBlock:
+			b.WriteString("<pre><code")
+			if len(node.Language) > 0 {
+				b.WriteString(` class="language-` + html.EscapeString(node.Language) + `"`)
+			}
+			b.WriteString(">" + html.EscapeString(node.Text) + "</code></pre>")
+		case Text:
+			b.WriteString(html.EscapeString(node.Text))
+		case LineBreak:
+			b.WriteString("<br>")
+		case Bold:
+			b.WriteString("<strong>")
+			render(b, node.Children)
+			b.WriteString("</strong>")
+		case Italic:
+			b.WriteString("<em>")
+			render(b, node.Children)
+			b.WriteString("</em>")
+		case Code:
+			b.WriteString("<code>" + html.EscapeString(node.Text) + "</code>")
+		case Link:
+			b.WriteString(`<a href="` + html.EscapeString(node.URL) + `" rel="nofollow noopener noreferrer" target="_blank">`)
+			render(b, node.Children)
+			b.WriteString("</a>")
+		}
+	}
+}
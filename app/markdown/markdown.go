@@ -0,0 +1,365 @@
+package markdown
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The subset is meant for chat messages: paragraphs, quotes and fenced code blocks, with bold, italic, inline
+// code and links inside them. Everything else, headings and lists included, stays plain text. Raw HTML is never
+// passed through, it is text like any other.
+
+// Types of nodes. Paragraphs, quotes and code blocks are the top level of the tree, the other nodes are their
+// children.
+const (
+	Paragraph = "paragraph"
+	Quote     = "quote"
+	CodeBlock = "code_block"
+	Text      = "text"
+	LineBreak = "line_break"
+	Bold      = "bold"
+	Italic    = "italic"
+	Code      = "code"
+	Link      = "link"
+)
+
+const fence = "```"
+
+// bold and italic nested deeper than this are left as plain text
+const maxDepth = 16
+
+var (
+	languagePattern = regexp.MustCompile(`^[a-zA-Z0-9_+#.-]{1,32}$`)
+	// characters which lose their meaning when preceded by a backslash
+	escapable = "\\`*_[]()>"
+	// links to other schemes, javascript: above all, are plain text
+	linkSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+)
+
+// Node is stored along with the message, hence the tags.
+type Node struct {
+	Type string `json:"type"`
+	// content of text, code and code_block nodes
+	Text string `json:"text,omitempty"`
+	// target of link nodes
+	URL string `json:"url,omitempty"`
+	// language of code_block nodes, may be empty
+	Language string `json:"language,omitempty"`
+	Children []Node `json:"children,omitempty"`
+}
+
+// Parse returns the blocks of the text. Lines starting with > form a quote, lines between two ``` lines form a
+// code block, blank lines separate paragraphs.
+func Parse(text string) []Node {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	blocks := make([]Node, 0)
+	for i := 0; i < len(lines); {
+		line := strings.TrimSpace(lines[i])
+		switch {
+		case len(line) == 0:
+			i++
+		case isFence(line):
+			language := strings.TrimSpace(line[len(fence):])
+			if !languagePattern.MatchString(language) {
+				language = ""
+			}
+
+			var code []string
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != fence; i++ {
+				code = append(code, strings.TrimRight(lines[i], " \t\r"))
+			}
+			// an unclosed block lasts until the end of the text
+			i++
+			blocks = append(blocks, Node{Type: CodeBlock, Text: strings.Join(code, "\n"), Language: language})
+		case strings.HasPrefix(line, ">"):
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quoted = append(quoted, strings.TrimSpace(strings.TrimSpace(lines[i])[1:]))
+			}
+			blocks = append(blocks, Node{Type: Quote, Children: parseInline(strings.Join(quoted, "\n"), 0, false)})
+		default:
+			var paragraph []string
+			for ; i < len(lines) && !startsBlock(lines[i]); i++ {
+				paragraph = append(paragraph, strings.TrimSpace(lines[i]))
+			}
+			blocks = append(blocks, Node{Type: Paragraph, Children: parseInline(strings.Join(paragraph, "\n"), 0, false)})
+		}
+	}
+
+	return blocks
+}
+
+// Escape returns markdown which renders as the text itself, for text inserted into messages by the server.
+// Parentheses are left alone, without brackets they make no link, and so is > unless it starts a line. Bare
+// URLs still become links, with themselves as the label.
+func Escape(text string) string {
+	var escaped strings.Builder
+	lineStart := true
+	for _, r := range text {
+		if (r == '>' && lineStart) || (r < utf8.RuneSelf && strings.IndexByte("\\`*_[]", byte(r)) >= 0) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+		lineStart = r == '\n' || (lineStart && unicode.IsSpace(r))
+	}
+
+	return escaped.String()
+}
+
+func isFence(line string) bool {
+	return strings.HasPrefix(line, fence) && !strings.Contains(line[len(fence):], "`")
+}
+
+func startsBlock(line string) bool {
+	line = strings.TrimSpace(line)
+	return len(line) == 0 || isFence(line) || strings.HasPrefix(line, ">")
+}
+
+// region inline
+
+func parseInline(text string, depth int, inLink bool) []Node {
+	var nodes []Node
+	var plain strings.Builder
+	flush := func() {
+		if plain.Len() > 0 {
+			nodes = append(nodes, Node{Type: Text, Text: plain.String()})
+			plain.Reset()
+		}
+	}
+	add := func(node Node) {
+		flush()
+		nodes = append(nodes, node)
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(escapable, text[i+1]) >= 0:
+			plain.WriteByte(text[i+1])
+			i += 2
+			continue
+		case c == '\n':
+			add(Node{Type: LineBreak})
+			i++
+			continue
+		case c == '`':
+			if content, end, ok := codeSpan(text, i); ok {
+				add(Node{Type: Code, Text: content})
+				i = end
+				continue
+			}
+			// an unmatched run of backticks is text as a whole, a shorter run must not match inside it
+			run := runLength(text, i)
+			plain.WriteString(text[i : i+run])
+			i += run
+			continue
+		case (c == '*' || c == '_') && depth < maxDepth:
+			if node, end, ok := emphasis(text, i, depth, inLink); ok {
+				add(node)
+				i = end
+				continue
+			}
+		case c == '[' && !inLink && depth < maxDepth:
+			if node, end, ok := link(text, i, depth); ok {
+				add(node)
+				i = end
+				continue
+			}
+		case c == 'h' && !inLink:
+			if node, end, ok := autolink(text, i); ok {
+				add(node)
+				i = end
+				continue
+			}
+		}
+
+		plain.WriteByte(c)
+		i++
+	}
+	flush()
+
+	return nodes
+}
+
+// codeSpan matches a run of backticks with the next run of the same length, like CommonMark.
+func codeSpan(text string, start int) (string, int, bool) {
+	run := runLength(text, start)
+	for i := start + run; i < len(text); {
+		if text[i] != '`' {
+			i++
+			continue
+		}
+
+		closing := runLength(text, i)
+		if closing == run {
+			content := text[start+run : i]
+			// a single space on both sides allows code starting or ending with a backtick
+			if len(content) > 2 && content[0] == ' ' && content[len(content)-1] == ' ' {
+				content = content[1 : len(content)-1]
+			}
+			return content, i + closing, true
+		}
+		i += closing
+	}
+
+	return "", 0, false
+}
+
+// emphasis matches ** or __ as bold and * or _ as italic. The opening delimiter must be followed and the
+// closing one preceded by a non-space, and underscores inside words, as in snake_case, are not delimiters.
+func emphasis(text string, start int, depth int, inLink bool) (Node, int, bool) {
+	c := text[start]
+	size, nodeType := 1, Italic
+	if runLength(text, start) >= 2 {
+		size, nodeType = 2, Bold
+	}
+
+	from := start + size
+	if from >= len(text) || isSpace(text[from:]) || (c == '_' && isWordBefore(text, start)) {
+		return Node{}, 0, false
+	}
+
+	for i := from + 1; i < len(text); {
+		switch text[i] {
+		case '\\':
+			i += 2
+			continue
+		case '`':
+			if _, end, ok := codeSpan(text, i); ok {
+				i = end
+				continue
+			}
+			i += runLength(text, i)
+			continue
+		case c:
+		default:
+			i++
+			continue
+		}
+
+		run := runLength(text, i)
+		// the closing delimiter is the end of the run, so that ***both*** is italic inside bold
+		closing := i + run - size
+		usable := run >= size && (size == 2 || run != 2)
+		if usable && !isSpaceBefore(text, closing) && !(c == '_' && isWordAfter(text, i+run)) {
+			children := parseInline(text[from:closing], depth+1, inLink)
+			return Node{Type: nodeType, Children: children}, closing + size, true
+		}
+		i += run
+	}
+
+	return Node{}, 0, false
+}
+
+// link matches [label](url) with an allowed URL. The label may contain formatting but no other links.
+func link(text string, start int, depth int) (Node, int, bool) {
+	closing := -1
+	for i := start + 1; i < len(text) && closing < 0; i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '\n', '[':
+			return Node{}, 0, false
+		case ']':
+			closing = i
+		}
+	}
+	if closing < 0 || closing+1 >= len(text) || text[closing+1] != '(' {
+		return Node{}, 0, false
+	}
+
+	end := strings.IndexByte(text[closing+2:], ')')
+	if end < 0 {
+		return Node{}, 0, false
+	}
+	end += closing + 2
+
+	target, ok := safeURL(strings.TrimSpace(text[closing+2 : end]))
+	if !ok {
+		return Node{}, 0, false
+	}
+
+	children := parseInline(text[start+1:closing], depth+1, true)
+	if len(children) == 0 {
+		children = []Node{{Type: Text, Text: target}}
+	}
+
+	return Node{Type: Link, URL: target, Children: children}, end + 1, true
+}
+
+// autolink matches a bare http(s) URL. Punctuation at its end is taken to belong to the sentence, except for
+// closing parentheses which have an opening one in the URL.
+func autolink(text string, start int) (Node, int, bool) {
+	rest := text[start:]
+	if (!strings.HasPrefix(rest, "http://") && !strings.HasPrefix(rest, "https://")) || isWordBefore(text, start) {
+		return Node{}, 0, false
+	}
+
+	end := strings.IndexFunc(rest, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '<' || r == '>' || r == '"' || r == '`'
+	})
+	if end < 0 {
+		end = len(rest)
+	}
+	for end > 0 {
+		last := rest[end-1]
+		if strings.IndexByte(".,:;!?'*_", last) < 0 &&
+			(last != ')' || strings.Count(rest[:end], "(") >= strings.Count(rest[:end], ")")) {
+			break
+		}
+		end--
+	}
+
+	target, ok := safeURL(rest[:end])
+	if !ok {
+		return Node{}, 0, false
+	}
+
+	return Node{Type: Link, URL: target, Children: []Node{{Type: Text, Text: rest[:end]}}}, start + end, true
+}
+
+func safeURL(target string) (string, bool) {
+	parsed, err := url.Parse(target)
+	if err != nil || !linkSchemes[strings.ToLower(parsed.Scheme)] {
+		return "", false
+	}
+	if parsed.Scheme != "mailto" && len(parsed.Host) == 0 {
+		return "", false
+	}
+
+	return parsed.String(), true
+}
+
+func runLength(text string, start int) int {
+	run := 1
+	for start+run < len(text) && text[start+run] == text[start] {
+		run++
+	}
+
+	return run
+}
+
+func isSpace(text string) bool {
+	r, _ := utf8.DecodeRuneInString(text)
+	return unicode.IsSpace(r)
+}
+
+func isSpaceBefore(text string, end int) bool {
+	r, _ := utf8.DecodeLastRuneInString(text[:end])
+	return unicode.IsSpace(r)
+}
+
+func isWordBefore(text string, end int) bool {
+	r, size := utf8.DecodeLastRuneInString(text[:end])
+	return size > 0 && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+func isWordAfter(text string, start int) bool {
+	r, size := utf8.DecodeRuneInString(text[start:])
+	return size > 0 && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// endregion
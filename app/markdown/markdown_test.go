@@ -0,0 +1,131 @@
+package markdown
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		html string
+	}{
+		{"plain", "hello", "<p>hello</p>"},
+		{"entities", `a & b "q" 'x'`, "<p>a &amp; b &#34;q&#34; &#39;x&#39;</p>"},
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"script in code", "`<script>`", "<p><code>&lt;script&gt;</code></p>"},
+		{"script in code block", "```\n</code><script>\n```", "<pre><code>&lt;/code&gt;&lt;script&gt;</code></pre>"},
+		{"invalid language", "```\"><script>\nx\n```", "<pre><code>x</code></pre>"},
+		{
+			"quote in link",
+			`[x](http://a.com/"onmouseover="alert(1))`,
+			`<p><a href="http://a.com/%22onmouseover=%22alert%281" rel="nofollow noopener noreferrer" target="_blank">x</a>)</p>`,
+		},
+		{
+			"quote in bare URL",
+			`https://a.com/"onmouseover="alert(1)`,
+			`<p><a href="https://a.com/" rel="nofollow noopener noreferrer" target="_blank">https://a.com/</a>&#34;onmouseover=&#34;alert(1)</p>`,
+		},
+		{"javascript link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"javascript link uppercase", "[x](JavaScript:alert(1))", "<p>[x](JavaScript:alert(1))</p>"},
+		{"data link", "[x](data:text/html,<script>)", "<p>[x](data:text/html,&lt;script&gt;)</p>"},
+		{"bare javascript", "javascript:alert(1)", "<p>javascript:alert(1)</p>"},
+		{
+			"link",
+			"[**bold** link](https://a.com)",
+			`<p><a href="https://a.com" rel="nofollow noopener noreferrer" target="_blank"><strong>bold</strong> link</a></p>`,
+		},
+		{
+			"bare URL with parentheses",
+			"see https://example.com/a_(b).",
+			`<p>see <a href="https://example.com/a_(b)" rel="nofollow noopener noreferrer" target="_blank">https://example.com/a_(b)</a>.</p>`,
+		},
+		{"bold", "**bold**", "<p><strong>bold</strong></p>"},
+		{"italic", "_italic_", "<p><em>italic</em></p>"},
+		{"italic in bold", "**bold *italic* bold**", "<p><strong>bold <em>italic</em> bold</strong></p>"},
+		{"bold in italic", "*italic **bold** italic*", "<p><em>italic <strong>bold</strong> italic</em></p>"},
+		{"both", "***both***", "<p><strong><em>both</em></strong></p>"},
+		{"snake case", "snake_case_name", "<p>snake_case_name</p>"},
+		{"space after delimiter", "* not italic*", "<p>* not italic*</p>"},
+		{"unclosed", "**not bold", "<p>**not bold</p>"},
+		{"escaped", `\*not italic\*`, "<p>*not italic*</p>"},
+		{"emphasis in code", "`a *b* c`", "<p><code>a *b* c</code></p>"},
+		{"code in emphasis", "*`code`*", "<p><em><code>code</code></em></p>"},
+		{"backtick in code", "``code with ` tick``", "<p><code>code with ` tick</code></p>"},
+		{"unmatched backticks", "``a`", "<p>``a`</p>"},
+		{"delimiter in code in emphasis", "*a `*` b*", "<p><em>a <code>*</code> b</em></p>"},
+		{"quote", "> quote\n> more", "<blockquote>quote<br>more</blockquote>"},
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one<br>two</p><p>three</p>"},
+		{
+			"code block",
+			"```go\nfmt.Println(\"<b>\")\n```",
+			`<pre><code class="language-go">fmt.Println(&#34;&lt;b&gt;&#34;)</code></pre>`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if html := RenderHTML(Parse(test.text)); html != test.html {
+				t.Errorf("RenderHTML(Parse(%q))\n got %q\nwant %q", test.text, html, test.html)
+			}
+		})
+	}
+}
+
+func TestParseNesting(t *testing.T) {
+	text := "**a *b `c*`* d**"
+	want := []Node{{Type: Paragraph, Children: []Node{
+		{Type: Bold, Children: []Node{
+			{Type: Text, Text: "a "},
+			{Type: Italic, Children: []Node{
+				{Type: Text, Text: "b "},
+				{Type: Code, Text: "c*"},
+			}},
+			{Type: Text, Text: " d"},
+		}},
+	}}}
+
+	if got := Parse(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse(%q)\n got %+v\nwant %+v", text, got, want)
+	}
+}
+
+func TestParseMaxDepth(t *testing.T) {
+	text := ""
+	for i := 0; i < 100; i++ {
+		text = "*" + text + "*"
+	}
+	text = "**" + text + "**"
+
+	// deeper emphasis is text, the point is that parsing ends
+	if html := RenderHTML(Parse(text)); len(html) == 0 {
+		t.Errorf("RenderHTML(Parse(%q)) is empty", text)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		html string
+	}{
+		{"shrug", `¯\_(ツ)_/¯`, `<p>¯\_(ツ)_/¯</p>`},
+		{"emphasis", "*a* __b__", "<p>*a* __b__</p>"},
+		{"code", "`a`", "<p>`a`</p>"},
+		{"link", "[a](https://a.com)", `<p>[a](<a href="https://a.com" rel="nofollow noopener noreferrer" target="_blank">https://a.com</a>)</p>`},
+		{"quote", "> a\n  > b", "<p>&gt; a<br>&gt; b</p>"},
+		{"greater than inside", "a > b", "<p>a &gt; b</p>"},
+		{"fence", "```\na\n```", "<p>```<br>a<br>```</p>"},
+		{"html", "<b>", "<p>&lt;b&gt;</p>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			escaped := Escape(test.text)
+			if html := RenderHTML(Parse(escaped)); html != test.html {
+				t.Errorf("RenderHTML(Parse(Escape(%q))) = RenderHTML(Parse(%q))\n got %q\nwant %q", test.text, escaped, html, test.html)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // registers the decoder for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// images larger than this are not decoded, a small file can declare enormous dimensions
+const MaxPixels = 16 * 1000 * 1000
+
+// images decoded at once; a decoded image takes up to 4 bytes per pixel, so this bounds the memory they take
+// to maxDecodes * MaxPixels * 4 bytes, 128 MB
+const maxDecodes = 2
+
+var decodeSlots = make(chan struct{}, maxDecodes)
+
+var ImageTooLarge = fmt.Errorf("image is too large")
+
+// IsImage reports whether thumbnails can be made of the content type.
+func IsImage(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+
+	return false
+}
+
+// DecodeConfig returns the dimensions of the image without decoding it.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if config.Width*config.Height > MaxPixels {
+		return config, ImageTooLarge
+	}
+
+	return config, nil
+}
+
+// Acquire waits until an image may be decoded, it returns the function to call once the decoded image is no
+// longer used.
+func Acquire() (release func()) {
+	decodeSlots <- struct{}{}
+	return func() {
+		<-decodeSlots
+	}
+}
+
+// Decode decodes the image, callers hold a slot from Acquire until they are done with it.
+func Decode(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	return img, err
+}
+
+// Fit scales the image down to fit into a size x size square, keeping the aspect ratio. Smaller images are
+// returned as they are.
+func Fit(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return src
+	}
+
+	if width > height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+
+	return Resize(src, width, height)
+}
+
+// Square crops the middle square of the image and scales it to size x size, as used for avatars.
+func Square(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	if sub, ok := src.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return Resize(sub.SubImage(image.Rect(x, y, x+side, y+side)), size, size)
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, side, side))
+	for dy := 0; dy < side; dy++ {
+		for dx := 0; dx < side; dx++ {
+			cropped.Set(dx, dy, src.At(x+dx, y+dy))
+		}
+	}
+
+	return Resize(cropped, size, size)
+}
+
+// Resize scales the image to the given dimensions. Every destination pixel is the average of the source
+// pixels it covers, which is good enough for downscaling.
+func Resize(src image.Image, width int, height int) image.Image {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
+
+// Encode writes the image as image/jpeg or image/png.
+func Encode(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "image/png":
+		return png.Encode(w, img)
+	}
+
+	return fmt.Errorf("cannot encode %s", contentType)
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,42 @@
+package mentions
+
+import (
+	"github.com/mazanax/go-chat/app/db"
+	"regexp"
+	"strings"
+)
+
+// usernames follow the "slug" rule of CreateUserRequest: 3 to 30 latin letters and digits
+var mentionPattern = regexp.MustCompile(`(?:^|[^a-zA-Z0-9_@])@([a-zA-Z0-9]{3,30})\b`)
+
+// Parse returns the lowercased usernames mentioned in the text, without duplicates, in order of appearance.
+func Parse(text string) []string {
+	var usernames []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		username := strings.ToLower(match[1])
+		if seen[username] {
+			continue
+		}
+
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+
+	return usernames
+}
+
+// Resolve returns the IDs of the existing users mentioned in the text. Unknown usernames are left as plain text.
+func Resolve(text string, users db.UserRepository) []string {
+	var userIDs []string
+	for _, username := range Parse(text) {
+		user, err := users.FindUserByUsername(username)
+		if err != nil {
+			continue
+		}
+
+		userIDs = append(userIDs, user.ID)
+	}
+
+	return userIDs
+}
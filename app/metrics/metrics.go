@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are latency buckets in seconds, the same as the Prometheus client defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	name() string
+	write(b *strings.Builder)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.value += delta
+	c.mu.Unlock()
+}
+
+func (c *Counter) get() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *Gauge) Set(value float64) {
+	g.mu.Lock()
+	g.value = value
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.mu.Lock()
+	g.value += delta
+	g.mu.Unlock()
+}
+
+func (g *Gauge) get() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+type family struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]interface{}
+	values map[string][]string
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+func (f *family) with(labelValues []string) interface{} {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.metricName, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if metric, ok := f.series[key]; ok {
+		return metric
+	}
+
+	var metric interface{}
+	switch f.kind {
+	case "counter":
+		metric = &Counter{}
+	case "gauge":
+		metric = &Gauge{}
+	case "histogram":
+		metric = newHistogram(f.buckets)
+	}
+	f.series[key] = metric
+	f.values[key] = append([]string(nil), labelValues...)
+
+	return metric
+}
+
+func (f *family) write(b *strings.Builder) {
+	_, _ = fmt.Fprintf(b, "# HELP %s %s\n", f.metricName, escapeHelp(f.help))
+	_, _ = fmt.Fprintf(b, "# TYPE %s %s\n", f.metricName, f.kind)
+
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		f.mu.Lock()
+		metric, values := f.series[key], f.values[key]
+		f.mu.Unlock()
+
+		labels := formatLabels(f.labels, values, "", "")
+		switch m := metric.(type) {
+		case *Counter:
+			_, _ = fmt.Fprintf(b, "%s%s %s\n", f.metricName, labels, formatFloat(m.get()))
+		case *Gauge:
+			_, _ = fmt.Fprintf(b, "%s%s %s\n", f.metricName, labels, formatFloat(m.get()))
+		case *Histogram:
+			m.mu.Lock()
+			for i, bound := range m.buckets {
+				le := formatLabels(f.labels, values, "le", formatFloat(bound))
+				_, _ = fmt.Fprintf(b, "%s_bucket%s %d\n", f.metricName, le, m.counts[i])
+			}
+			_, _ = fmt.Fprintf(b, "%s_bucket%s %d\n", f.metricName, formatLabels(f.labels, values, "le", "+Inf"), m.count)
+			_, _ = fmt.Fprintf(b, "%s_sum%s %s\n", f.metricName, labels, formatFloat(m.sum))
+			_, _ = fmt.Fprintf(b, "%s_count%s %d\n", f.metricName, labels, m.count)
+			m.mu.Unlock()
+		}
+	}
+}
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && len(extraName) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
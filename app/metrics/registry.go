@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// Default is the registry used by the package level constructors and Handler.
+var Default = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.collectors[c.name()]; ok {
+		panic(fmt.Sprintf("metrics: %s is already registered", c.name()))
+	}
+	r.collectors[c.name()] = c
+}
+
+// Handler serves all registered metrics in the Prometheus text exposition format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		r.mu.Lock()
+		names := make([]string, 0, len(r.collectors))
+		for name := range r.collectors {
+			names = append(names, name)
+		}
+		collectors := make([]collector, 0, len(names))
+		sort.Strings(names)
+		for _, name := range names {
+			collectors = append(collectors, r.collectors[name])
+		}
+		r.mu.Unlock()
+
+		var b strings.Builder
+		for _, c := range collectors {
+			c.write(&b)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte(b.String()))
+	})
+}
+
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+type CounterVec struct{ f *family }
+
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.f.with(values).(*Counter)
+}
+
+type GaugeVec struct{ f *family }
+
+func (v *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return v.f.with(values).(*Gauge)
+}
+
+type HistogramVec struct{ f *family }
+
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.f.with(values).(*Histogram)
+}
+
+func newFamily(name string, help string, kind string, labels []string, buckets []float64) *family {
+	f := &family{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		buckets:    buckets,
+		series:     make(map[string]interface{}),
+		values:     make(map[string][]string),
+	}
+	Default.register(f)
+
+	return f
+}
+
+func NewCounter(name string, help string) *Counter {
+	return newFamily(name, help, "counter", nil, nil).with(nil).(*Counter)
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: newFamily(name, help, "counter", labels, nil)}
+}
+
+func NewGauge(name string, help string) *Gauge {
+	return newFamily(name, help, "gauge", nil, nil).with(nil).(*Gauge)
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: newFamily(name, help, "gauge", labels, nil)}
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return newFamily(name, help, "histogram", nil, buckets).with(nil).(*Histogram)
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{f: newFamily(name, help, "histogram", labels, buckets)}
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/metrics"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// requestIDMiddleware tags every request with an ID, taken from the X-Request-ID header when the proxy
+// already assigned one, and puts a logger carrying it into the request context.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		log := logger.With("request_id", requestID)
+		next.ServeHTTP(w, r.WithContext(logger.NewContext(r.Context(), log)))
+	})
+}
+
+var (
+	httpRequests = metrics.NewCounterVec(
+		"chat_http_requests_total",
+		"HTTP requests by route, method and status code.",
+		"route", "method", "code",
+	)
+	httpDuration = metrics.NewHistogramVec(
+		"chat_http_request_duration_seconds",
+		"HTTP request latency by route and method.",
+		metrics.DefaultBuckets,
+		"route", "method",
+	)
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack is required by the websocket upgrader.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Flush is required by the event stream.
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// metricsMiddleware counts requests per route template registered in initRoutes, not per raw URL,
+// so that /api/user/{uuid} stays a single series.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		httpDuration.WithLabelValues(route, r.Method).ObserveSince(start)
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+	})
+}
@@ -0,0 +1,38 @@
+package models
+
+const (
+	AuditSignUp                 = "signup"
+	AuditLogin                  = "login"
+	AuditLoginFailed            = "login_failed"
+	AuditLogout                 = "logout"
+	AuditPasswordResetRequested = "password_reset_requested"
+	AuditPasswordReset          = "password_reset"
+	AuditProfileUpdated         = "profile_updated"
+	AuditTokenCreated           = "token_created"
+	AuditTicketCreated          = "ticket_created"
+	AuditMailRequeued           = "mail_requeued"
+	AuditNotificationsUpdated   = "notifications_updated"
+	AuditUnsubscribed           = "unsubscribed"
+	AuditRetentionChanged       = "retention_changed"
+	AuditTopicChanged           = "topic_changed"
+)
+
+type AuditEvent struct {
+	ID        string
+	Type      string
+	ActorID   string
+	TargetID  string
+	IP        string
+	CreatedAt int
+	Data      map[string]string
+}
+
+type JsonAuditEvent struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	ActorID   string            `json:"actor_id"`
+	TargetID  string            `json:"target_id"`
+	IP        string            `json:"ip"`
+	CreatedAt int               `json:"created_at"`
+	Data      map[string]string `json:"data,omitempty"`
+}
@@ -0,0 +1,16 @@
+package models
+
+const (
+	HealthUp   = "up"
+	HealthDown = "down"
+)
+
+type JsonComponentHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type JsonHealth struct {
+	Status     string                         `json:"status"`
+	Components map[string]JsonComponentHealth `json:"components,omitempty"`
+}
@@ -0,0 +1,24 @@
+package models
+
+type Mail struct {
+	ID        string
+	To        string
+	Subject   string
+	Message   string
+	Attempts  int
+	LastError string
+	CreatedAt int
+	// unix time of the next delivery attempt, or of the moment the mail was dead-lettered
+	NextAttemptAt int
+}
+
+// JsonMail leaves the message body out: it may contain password reset links.
+type JsonMail struct {
+	ID            string `json:"id"`
+	To            string `json:"to"`
+	Subject       string `json:"subject"`
+	Attempts      int    `json:"attempts"`
+	LastError     string `json:"last_error"`
+	CreatedAt     int    `json:"created_at"`
+	NextAttemptAt int    `json:"next_attempt_at"`
+}
@@ -0,0 +1,66 @@
+package models
+
+import "github.com/mazanax/go-chat/app/markdown"
+
+// The mappers below are shared by the REST API, the websocket hub and the workers, which all send messages.
+
+func MapPreviewsToJson(previews []LinkPreview) []JsonLinkPreview {
+	jsonPreviews := make([]JsonLinkPreview, 0, len(previews))
+	for _, preview := range previews {
+		jsonPreviews = append(jsonPreviews, JsonLinkPreview{
+			URL:         preview.URL,
+			Title:       preview.Title,
+			Description: preview.Description,
+			ImageURL:    preview.ImageURL,
+			SiteName:    preview.SiteName,
+		})
+	}
+
+	return jsonPreviews
+}
+
+func MapMarkupToJson(nodes []markdown.Node) []JsonNode {
+	jsonNodes := make([]JsonNode, 0, len(nodes))
+	for _, node := range nodes {
+		jsonNode := JsonNode{
+			Type:     node.Type,
+			Text:     node.Text,
+			URL:      node.URL,
+			Language: node.Language,
+		}
+		if len(node.Children) > 0 {
+			jsonNode.Children = MapMarkupToJson(node.Children)
+		}
+		jsonNodes = append(jsonNodes, jsonNode)
+	}
+
+	return jsonNodes
+}
+
+func MapUploadsToJson(uploads []Upload) []JsonUpload {
+	jsonUploads := make([]JsonUpload, 0, len(uploads))
+	for _, upload := range uploads {
+		jsonUploads = append(jsonUploads, MapUploadToJson(upload))
+	}
+
+	return jsonUploads
+}
+
+func MapUploadToJson(upload Upload) JsonUpload {
+	jsonUpload := JsonUpload{
+		ID:          upload.ID,
+		UserID:      upload.UserID,
+		Name:        upload.Name,
+		ContentType: upload.ContentType,
+		Size:        upload.Size,
+		Width:       upload.Width,
+		Height:      upload.Height,
+		URL:         "/api/uploads/" + upload.ID,
+		CreatedAt:   upload.CreatedAt,
+	}
+	if upload.HasThumbnail {
+		jsonUpload.ThumbnailURL = "/api/uploads/" + upload.ID + "/thumbnail"
+	}
+
+	return jsonUpload
+}
@@ -1,15 +1,41 @@
 package models
 
+import (
+	"github.com/mazanax/go-chat/app/markdown"
+	"time"
+)
+
 const (
-	UserRegistered   = -1
+	UserRegistered = -1
+	// Data holds the new public profile, clients refresh their cached copy
+	UserUpdated = -2
+	// an admin changed the topic of the chat, Data holds the new JsonTopic
+	TopicChanged     = -3
 	UserConnected    = -100
 	UserDisconnected = -101
 	RegularMessage   = 0
+	// sent with /me, the text says what the user is doing
+	ActionMessage = 1
+	// sent with /msg to a single user, Data holds the ID of the recipient
+	DirectMessage = 2
+	// sent only to the mentioned users, Data holds the ID of the message
+	UserMentioned = -200
+	// sent instead of the replay when the missed events are no longer buffered, the client reloads the history
+	ResyncRequired = -300
+	// sent before the next events when older ones were dropped because the client did not keep up, Data holds
+	// the number of dropped events
+	EventsDropped = -301
+	// previews of the links in a message were fetched, Data holds a JsonMessagePreviews
+	PreviewsAttached = -400
+	// answer to a command, sent only to the connection which ran it and never stored
+	CommandReply = -500
 )
 
 type WebsocketMessage struct {
 	ID   string `json:"id"`
 	Text string `json:"text"`
+	// IDs of files uploaded by the sender with POST /api/uploads
+	Attachments []string `json:"attachments"`
 }
 
 type Message struct {
@@ -18,14 +44,124 @@ type Message struct {
 	Type      int
 	CreatedAt int
 	Text      string
-	Data      interface{}
+	// the text parsed and rendered by Render, once when the message is stored rather than for every recipient
+	HTML   string
+	Markup []markdown.Node
+	// IDs of the users mentioned in the text
+	Mentions    []string
+	Attachments []Upload
+	// previews of the links in the text, attached by the unfurler some time after the message was stored
+	Previews []LinkPreview
+	Data     interface{}
+	// sequence number assigned by the hub, 0 if the message was not broadcast over websocket
+	Seq int64
+}
+
+// Render fills HTML and Markup from the text.
+func (message *Message) Render() {
+	message.Markup = markdown.Parse(message.Text)
+	message.HTML = markdown.RenderHTML(message.Markup)
+}
+
+// HubEvent is a message broadcast by the hub, kept for a while to be replayed to reconnecting clients.
+type HubEvent struct {
+	Seq int64
+	// users the event was sent to, empty if it was sent to everybody
+	Recipients []string
+	Message    Message
 }
 
 type JsonMessage struct {
-	ID        string      `json:"id"`
-	UserID    string      `json:"user_id"`
-	Type      int         `json:"type"`
-	CreatedAt int         `json:"created_at"`
-	Text      string      `json:"text"`
-	Data      interface{} `json:"data"`
+	ID          string            `json:"id"`
+	UserID      string            `json:"user_id"`
+	Type        int               `json:"type"`
+	CreatedAt   int               `json:"created_at"`
+	Text        string            `json:"text"`
+	HTML        string            `json:"html"`
+	AST         []JsonNode        `json:"ast"`
+	Mentions    []string          `json:"mentions"`
+	Attachments []JsonUpload      `json:"attachments"`
+	Previews    []JsonLinkPreview `json:"previews"`
+	Data        interface{}       `json:"data"`
+	Seq         int64             `json:"seq,omitempty"`
+}
+
+// JsonNode is a node of the markdown tree of a message, see docs/websocket-protocol.md for the types.
+type JsonNode struct {
+	Type     string     `json:"type"`
+	Text     string     `json:"text,omitempty"`
+	URL      string     `json:"url,omitempty"`
+	Language string     `json:"language,omitempty"`
+	Children []JsonNode `json:"children,omitempty"`
+}
+
+// LinkPreview describes the page behind a URL, from its OpenGraph tags or its title. A preview with neither
+// title nor description stands for a page which has nothing to show.
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+	SiteName    string
+}
+
+type JsonLinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	ImageURL    string `json:"image_url"`
+	SiteName    string `json:"site_name"`
+}
+
+type JsonMessagePreviews struct {
+	MessageID string            `json:"message_id"`
+	Previews  []JsonLinkPreview `json:"previews"`
+}
+
+// JsonEvents is a batch of hub events returned by long polling, oldest first.
+type JsonEvents struct {
+	Events []JsonMessage `json:"events"`
+}
+
+type JsonSearchResult struct {
+	Message JsonMessage `json:"message"`
+	// HTML fragment of the text with the matching words in <mark>
+	Snippet string `json:"snippet"`
+}
+
+type JsonSearchResponse struct {
+	Total   int                `json:"total"`
+	Results []JsonSearchResult `json:"results"`
+}
+
+// Topic is shown above the chat, a topic without text means there is none.
+type Topic struct {
+	Text      string
+	UserID    string
+	UpdatedAt int
+}
+
+type JsonTopic struct {
+	Text      string `json:"text"`
+	UserID    string `json:"user_id"`
+	UpdatedAt int    `json:"updated_at"`
+}
+
+// RetentionPolicy limits the history, zero values mean no limit.
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+type JsonRetentionPolicy struct {
+	// in seconds
+	MaxAge   int `json:"max_age"`
+	MaxCount int `json:"max_count"`
+	// whether the policy was set by an admin instead of coming from the configuration
+	Overridden bool `json:"overridden"`
+}
+
+type UpdateRetentionPolicyRequest struct {
+	MaxAge   int `json:"max_age" validate:"min=0"`
+	MaxCount int `json:"max_count" validate:"min=0"`
 }
@@ -0,0 +1,36 @@
+package models
+
+const (
+	DigestMention       = "mention"
+	DigestDirectMessage = "direct_message"
+)
+
+type NotificationPreferences struct {
+	Mentions       bool
+	DirectMessages bool
+}
+
+// DefaultNotificationPreferences are used until the user changes them.
+var DefaultNotificationPreferences = NotificationPreferences{
+	Mentions:       true,
+	DirectMessages: true,
+}
+
+type JsonNotificationPreferences struct {
+	Mentions       bool `json:"mentions"`
+	DirectMessages bool `json:"direct_messages"`
+}
+
+type UpdateNotificationPreferencesRequest struct {
+	Mentions       *bool `json:"mentions"`
+	DirectMessages *bool `json:"direct_messages"`
+}
+
+// DigestItem is a message waiting to be included in the next email digest of an offline user.
+type DigestItem struct {
+	Type      string `json:"type"`
+	MessageID string `json:"message_id"`
+	AuthorID  string `json:"author_id"`
+	Text      string `json:"text"`
+	CreatedAt int    `json:"created_at"`
+}
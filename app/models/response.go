@@ -35,6 +35,18 @@ var (
 		Message: "Invalid email or password",
 		Code:    http.StatusUnauthorized,
 	}
+	NotFound = ErrorResponse{
+		Message: "Not found",
+		Code:    http.StatusNotFound,
+	}
+	FileTooLarge = ErrorResponse{
+		Message: "File is too large",
+		Code:    http.StatusRequestEntityTooLarge,
+	}
+	UnsupportedFileType = ErrorResponse{
+		Message: "File type is not allowed",
+		Code:    http.StatusUnsupportedMediaType,
+	}
 	Unauthorized = ErrorResponse{
 		Message: "Unauthorized",
 		Code:    http.StatusUnauthorized,
@@ -0,0 +1,27 @@
+package models
+
+type Upload struct {
+	ID          string
+	UserID      string
+	Name        string
+	ContentType string
+	Size        int
+	// dimensions of images, zero for other files
+	Width        int
+	Height       int
+	HasThumbnail bool
+	CreatedAt    int
+}
+
+type JsonUpload struct {
+	ID           string `json:"id"`
+	UserID       string `json:"user_id"`
+	Name         string `json:"name"`
+	ContentType  string `json:"content_type"`
+	Size         int    `json:"size"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	CreatedAt    int    `json:"created_at"`
+}
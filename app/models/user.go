@@ -8,6 +8,13 @@ type User struct {
 	Password  string
 	CreatedAt int
 	UpdatedAt int
+
+	Bio      string
+	Status   string
+	Timezone string
+	Pronouns string
+	// unix time of the last avatar upload, zero if the user has no avatar
+	AvatarVersion int
 }
 
 type JsonUser struct {
@@ -17,6 +24,13 @@ type JsonUser struct {
 	Name      string `json:"name"`
 	CreatedAt int    `json:"created_at"`
 	UpdatedAt int    `json:"updated_at"`
+
+	Bio      string `json:"bio"`
+	Status   string `json:"status"`
+	Timezone string `json:"timezone"`
+	Pronouns string `json:"pronouns"`
+	// avatar URLs by size in pixels, empty if the user has no avatar
+	Avatar map[string]string `json:"avatar,omitempty"`
 }
 
 type CreateUserRequest struct {
@@ -30,6 +44,12 @@ type UpdateUserRequest struct {
 	Email    string `json:"email" validate:"omitempty,email"`
 	Name     string `json:"name" validate:"omitempty,min=2,max=255"`
 	Password string `json:"password" validate:"omitempty,min=6,max=255"`
+
+	// nil keeps the value, an empty string clears it
+	Bio      *string `json:"bio" validate:"omitempty,max=500"`
+	Status   *string `json:"status" validate:"omitempty,max=100"`
+	Timezone *string `json:"timezone" validate:"omitempty,timezone"`
+	Pronouns *string `json:"pronouns" validate:"omitempty,max=40"`
 }
 
 type LoginRequest struct {
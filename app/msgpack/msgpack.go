@@ -0,0 +1,375 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// The codec works on the JSON data model: values are encoded the way encoding/json sees them, so struct tags
+// apply, and decoded documents are converted to JSON for the existing parsers. Extension types are not supported.
+
+// nesting deeper than this is rejected, a few bytes could otherwise exhaust the stack
+const maxDepth = 64
+
+var (
+	Truncated       = fmt.Errorf("msgpack: unexpected end of data")
+	TooDeep         = fmt.Errorf("msgpack: nesting is too deep")
+	UnsupportedType = fmt.Errorf("msgpack: unsupported type")
+)
+
+// Marshal encodes v as MessagePack.
+func Marshal(v interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var e encoder
+	if err := e.encode(value); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+// ToJSON converts a MessagePack document to JSON. Map keys must be strings, binary data becomes a string.
+func ToJSON(data []byte) ([]byte, error) {
+	d := decoder{data: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.offset != len(d.data) {
+		return nil, fmt.Errorf("msgpack: %d bytes after the document", len(d.data)-d.offset)
+	}
+
+	return json.Marshal(value)
+}
+
+// region encoder
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) encode(value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if value {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case json.Number:
+		return e.number(value)
+	case string:
+		e.header(len(value), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		e.buf = append(e.buf, value...)
+	case []interface{}:
+		e.header(len(value), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range value {
+			if err := e.encode(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		e.header(len(value), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			_ = e.encode(key)
+			if err := e.encode(value[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return UnsupportedType
+	}
+
+	return nil
+}
+
+func (e *encoder) number(number json.Number) error {
+	if n, err := strconv.ParseInt(string(number), 10, 64); err == nil {
+		e.int(n)
+		return nil
+	}
+	if n, err := strconv.ParseUint(string(number), 10, 64); err == nil {
+		e.uint(n)
+		return nil
+	}
+
+	f, err := number.Float64()
+	if err != nil {
+		return err
+	}
+	e.buf = append(e.buf, 0xcb)
+	e.buf = appendUint64(e.buf, math.Float64bits(f))
+
+	return nil
+}
+
+func (e *encoder) int(n int64) {
+	switch {
+	case n >= 0:
+		e.uint(uint64(n))
+	case n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.buf = appendUint16(append(e.buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		e.buf = appendUint32(append(e.buf, 0xd2), uint32(n))
+	default:
+		e.buf = appendUint64(append(e.buf, 0xd3), uint64(n))
+	}
+}
+
+func (e *encoder) uint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.buf = append(e.buf, byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = appendUint16(append(e.buf, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = appendUint32(append(e.buf, 0xce), uint32(n))
+	default:
+		e.buf = appendUint64(append(e.buf, 0xcf), n)
+	}
+}
+
+// header writes the type and length of a string, array or map: the fix format up to fixLimit, then the 8-bit
+// format if the type has one, then the 16 and 32-bit formats.
+func (e *encoder) header(length int, fix byte, fixLimit int, format8 byte, format16 byte, format32 byte) {
+	switch {
+	case length < fixLimit:
+		e.buf = append(e.buf, fix|byte(length))
+	case format8 != 0 && length <= math.MaxUint8:
+		e.buf = append(e.buf, format8, byte(length))
+	case length <= math.MaxUint16:
+		e.buf = appendUint16(append(e.buf, format16), uint16(length))
+	default:
+		e.buf = appendUint32(append(e.buf, format32), uint32(length))
+	}
+}
+
+func appendUint16(buf []byte, n uint16) []byte {
+	return append(buf, byte(n>>8), byte(n))
+}
+
+func appendUint32(buf []byte, n uint32) []byte {
+	return append(buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(buf []byte, n uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(n>>32)), uint32(n))
+}
+
+// endregion
+
+// region decoder
+
+type decoder struct {
+	data   []byte
+	offset int
+}
+
+func (d *decoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, TooDeep
+	}
+
+	format, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case format <= 0x7f:
+		return json.Number(strconv.Itoa(int(format))), nil
+	case format >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(format)))), nil
+	case format >= 0xa0 && format <= 0xbf:
+		return d.string(int(format & 0x1f))
+	case format >= 0x90 && format <= 0x9f:
+		return d.array(int(format&0x0f), depth)
+	case format >= 0x80 && format <= 0x8f:
+		return d.object(int(format&0x0f), depth)
+	}
+
+	switch format {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (format - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatUint(n, 10)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (format - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extension from the size of the value
+		shift := uint(64 - 8*size)
+		return json.Number(strconv.FormatInt(int64(n<<shift)>>shift, 10)), nil
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float(float64(math.Float32frombits(uint32(n))))
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return float(math.Float64frombits(n))
+	case 0xd9, 0xda, 0xdb:
+		length, err := d.uint(1 << (format - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.string(int(length))
+	case 0xc4, 0xc5, 0xc6:
+		length, err := d.uint(1 << (format - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.string(int(length))
+	case 0xdc, 0xdd:
+		length, err := d.uint(2 << (format - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(length), depth)
+	case 0xde, 0xdf:
+		length, err := d.uint(2 << (format - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(int(length), depth)
+	}
+
+	return nil, UnsupportedType
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.offset >= len(d.data) {
+		return 0, Truncated
+	}
+	d.offset++
+
+	return d.data[d.offset-1], nil
+}
+
+func (d *decoder) uint(size int) (uint64, error) {
+	if len(d.data)-d.offset < size {
+		return 0, Truncated
+	}
+
+	var n uint64
+	switch size {
+	case 1:
+		n = uint64(d.data[d.offset])
+	case 2:
+		n = uint64(binary.BigEndian.Uint16(d.data[d.offset:]))
+	case 4:
+		n = uint64(binary.BigEndian.Uint32(d.data[d.offset:]))
+	default:
+		n = binary.BigEndian.Uint64(d.data[d.offset:])
+	}
+	d.offset += size
+
+	return n, nil
+}
+
+func (d *decoder) string(length int) (string, error) {
+	if length < 0 || len(d.data)-d.offset < length {
+		return "", Truncated
+	}
+	d.offset += length
+
+	return string(d.data[d.offset-length : d.offset]), nil
+}
+
+func (d *decoder) array(length int, depth int) (interface{}, error) {
+	// every item takes at least a byte, a forged length must not allocate more than the data
+	if length < 0 || len(d.data)-d.offset < length {
+		return nil, Truncated
+	}
+
+	items := make([]interface{}, 0, length)
+	for i := 0; i < length; i++ {
+		item, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (d *decoder) object(length int, depth int) (interface{}, error) {
+	if length < 0 || len(d.data)-d.offset < 2*length {
+		return nil, Truncated
+	}
+
+	object := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map keys must be strings")
+		}
+
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		object[name] = value
+	}
+
+	return object, nil
+}
+
+func float(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("msgpack: %v cannot be represented in JSON", f)
+	}
+
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+// endregion
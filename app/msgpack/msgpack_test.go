@@ -0,0 +1,174 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		format byte
+	}{
+		{"nil", nil, 0xc0},
+		{"false", false, 0xc2},
+		{"true", true, 0xc3},
+		{"positive fixint", 127, 0x7f},
+		{"uint8", 200, 0xcc},
+		{"uint16", 65535, 0xcd},
+		{"uint32", 1 << 31, 0xce},
+		{"uint64", uint64(1) << 63, 0xcf},
+		{"negative fixint", -32, 0xe0},
+		{"int8", -33, 0xd0},
+		{"int16", -129, 0xd1},
+		{"int32", -32769, 0xd2},
+		{"int64", -2147483649, 0xd3},
+		{"float", 1.5, 0xcb},
+		{"negative float", -0.25, 0xcb},
+		{"large float", 1e21, 0xcb},
+		{"fixstr", "abc", 0xa3},
+		{"empty fixstr", "", 0xa0},
+		{"unicode fixstr", "привет", 0xac},
+		{"str8", strings.Repeat("a", 32), 0xd9},
+		{"str16", strings.Repeat("a", 256), 0xda},
+		{"str32", strings.Repeat("a", 65536), 0xdb},
+		{"fixarray", make([]int, 15), 0x9f},
+		{"empty fixarray", []int{}, 0x90},
+		{"array16", make([]int, 16), 0xdc},
+		{"array32", make([]int, 65536), 0xdd},
+		{"fixmap", keys(15), 0x8f},
+		{"map16", keys(16), 0xde},
+		{"map32", keys(65536), 0xdf},
+		{
+			"nested",
+			map[string]interface{}{"op": "send", "data": map[string]interface{}{"id": "x", "attachments": []string{"a", "b"}, "n": -7}},
+			0x82,
+		},
+		{"struct tags", struct {
+			Text string `json:"text"`
+			Seq  int64  `json:"seq,omitempty"`
+		}{Text: "hi"}, 0x81},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := Marshal(test.value)
+			if err != nil {
+				t.Fatalf("Marshal: %s", err)
+			}
+			if encoded[0] != test.format {
+				t.Errorf("format is 0x%02x, want 0x%02x", encoded[0], test.format)
+			}
+
+			decoded, err := ToJSON(encoded)
+			if err != nil {
+				t.Fatalf("ToJSON: %s", err)
+			}
+			want, _ := json.Marshal(test.value)
+			if !bytes.Equal(decoded, want) {
+				t.Errorf("round trip gives %.200s, want %.200s", decoded, want)
+			}
+		})
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		json string
+	}{
+		{"bin8", []byte{0xc4, 0x03, 'a', 'b', 'c'}, `"abc"`},
+		{"bin16", []byte{0xc5, 0x00, 0x02, 'h', 'i'}, `"hi"`},
+		{"bin32", []byte{0xc6, 0x00, 0x00, 0x00, 0x01, 'x'}, `"x"`},
+		{"float32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, `1.5`},
+		{"int8", []byte{0xd0, 0x80}, `-128`},
+		{"int16", []byte{0xd1, 0xff, 0xfe}, `-2`},
+		{"int32", []byte{0xd2, 0x80, 0x00, 0x00, 0x00}, `-2147483648`},
+		{"int64", []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, `-1`},
+		{"uint64", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, `18446744073709551615`},
+		{"str8 in a fixmap", []byte{0x81, 0xd9, 0x01, 'k', 0xa1, 'v'}, `{"k":"v"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := ToJSON(test.data)
+			if err != nil {
+				t.Fatalf("ToJSON: %s", err)
+			}
+			if string(decoded) != test.json {
+				t.Errorf("ToJSON gives %s, want %s", decoded, test.json)
+			}
+		})
+	}
+}
+
+func TestToJSONTruncated(t *testing.T) {
+	encoded, err := Marshal(map[string]interface{}{
+		"text":  strings.Repeat("a", 300),
+		"items": []interface{}{1, -200, 70000, 1.5, nil, true, "b"},
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+
+	for i := 0; i < len(encoded); i++ {
+		if _, err := ToJSON(encoded[:i]); !errors.Is(err, Truncated) {
+			t.Fatalf("ToJSON of the first %d bytes of %d gives %v, want %v", i, len(encoded), err, Truncated)
+		}
+	}
+}
+
+func TestToJSONInvalid(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x91}, maxDepth+2)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, Truncated},
+		{"oversized str32", []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}, Truncated},
+		{"oversized bin32", []byte{0xc6, 0xff, 0xff, 0xff, 0xff, 'a'}, Truncated},
+		{"oversized array32", []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0}, Truncated},
+		{"oversized map32", []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'k', 0xc0}, Truncated},
+		{"oversized array16", []byte{0xdc, 0xff, 0xff, 0xc0, 0xc0}, Truncated},
+		{"too deep", nested, TooDeep},
+		{"extension", []byte{0xd4, 0x01, 0x00}, UnsupportedType},
+		{"never used", []byte{0xc1}, UnsupportedType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ToJSON(test.data); !errors.Is(err, test.err) {
+				t.Errorf("ToJSON gives %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	for name, data := range map[string][]byte{
+		"trailing bytes": {0xc0, 0xc0},
+		"integer key":    {0x81, 0x01, 0xc0},
+		"NaN":            {0xcb, 0x7f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01},
+		"infinity":       {0xca, 0x7f, 0x80, 0x00, 0x00},
+	} {
+		if decoded, err := ToJSON(data); err == nil {
+			t.Errorf("%s: ToJSON gives %s, want an error", name, decoded)
+		}
+	}
+}
+
+// keys returns a map with n distinct keys.
+func keys(n int) map[string]int {
+	m := make(map[string]int, n)
+	for i := 0; i < n; i++ {
+		m["k"+strconv.Itoa(i)] = i
+	}
+
+	return m
+}
@@ -0,0 +1,20 @@
+package notifier
+
+import "github.com/mazanax/go-chat/app/metrics"
+
+var (
+	itemsQueued = metrics.NewCounterVec(
+		"chat_notifications_queued_total",
+		"Messages queued for the email digest of an offline user, by type.",
+		"type",
+	)
+	digestsSent = metrics.NewCounter(
+		"chat_notification_digests_sent_total",
+		"Notification digests handed over to the mailer.",
+	)
+	digestsSkipped = metrics.NewCounterVec(
+		"chat_notification_digests_skipped_total",
+		"Due digests that were not sent, by reason.",
+		"reason",
+	)
+)
@@ -0,0 +1,307 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mazanax/go-chat/app/db"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/mailer"
+	"github.com/mazanax/go-chat/app/models"
+	"net/mail"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// how often the schedule is checked for due digests
+	pollInterval = 15 * time.Second
+	// digests claimed at once
+	claimBatch = 100
+	// longer messages are cut in the digest, the full text is in the chat
+	maxExcerptLength = 200
+)
+
+var NotifierNotRunning = fmt.Errorf("notifier is not running")
+
+type Config struct {
+	// the first notification of an offline user waits this long, so that the following ones share one email
+	DigestWindow time.Duration
+	// signs the unsubscribe links
+	Secret string
+	// public URL of the chat, used in links
+	PublicHost string
+	// locale of the digests, users do not have one yet
+	Locale string
+}
+
+// Notifier emails users about mentions and direct messages they missed while offline. Notifications are
+// collected per user for the digest window and sent as a single email.
+type Notifier struct {
+	users      db.UserRepository
+	online     db.OnlineRepository
+	repository db.NotificationRepository
+	mailer     *mailer.Mailer
+
+	digestWindow time.Duration
+	secret       []byte
+	publicHost   string
+	locale       string
+
+	// liveness probes, Run closes every received channel
+	ping chan chan struct{}
+}
+
+func New(
+	config Config,
+	users db.UserRepository,
+	online db.OnlineRepository,
+	repository db.NotificationRepository,
+	mailer_ *mailer.Mailer,
+) *Notifier {
+	return &Notifier{
+		users:      users,
+		online:     online,
+		repository: repository,
+		mailer:     mailer_,
+
+		digestWindow: config.DigestWindow,
+		secret:       []byte(config.Secret),
+		publicHost:   config.PublicHost,
+		locale:       config.Locale,
+
+		ping: make(chan chan struct{}),
+	}
+}
+
+// MessageStored queues a digest item for every offline user mentioned in the message.
+func (n *Notifier) MessageStored(message models.Message) {
+	if message.Type != models.RegularMessage && message.Type != models.ActionMessage {
+		return
+	}
+
+	for _, userID := range message.Mentions {
+		if userID == message.UserID {
+			continue
+		}
+
+		n.queue(userID, models.DigestMention, message)
+	}
+}
+
+// DirectMessageSent queues a digest item for the recipient if they are offline.
+func (n *Notifier) DirectMessageSent(message models.Message, recipientID string) {
+	n.queue(recipientID, models.DigestDirectMessage, message)
+}
+
+func (n *Notifier) queue(userID string, itemType string, message models.Message) {
+	log := logger.With("user_id", userID, "message_id", message.ID)
+	if n.online.IsUserOnline(userID) {
+		return
+	}
+
+	preferences, err := n.repository.GetNotificationPreferences(userID)
+	if err != nil {
+		log.Error("[notifier] Cannot get notification preferences: %s\n", err)
+		return
+	}
+	if !wants(preferences, itemType) {
+		return
+	}
+
+	item := models.DigestItem{
+		Type:      itemType,
+		MessageID: message.ID,
+		AuthorID:  message.UserID,
+		Text:      excerpt(message.Text),
+		CreatedAt: message.CreatedAt,
+	}
+	if err := n.repository.AddDigestItem(userID, item, time.Now().Add(n.digestWindow)); err != nil {
+		log.Error("[notifier] Cannot queue %s notification: %s\n", itemType, err)
+		return
+	}
+
+	itemsQueued.WithLabelValues(itemType).Inc()
+	log.Debug("[notifier] Queued %s notification\n", itemType)
+}
+
+// Run sends due digests until the context is cancelled.
+func (n *Notifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	n.sendDue()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("[notifier] Stopped\n")
+			return
+		case reply := <-n.ping:
+			// probes do no work, or every readiness check would claim digests
+			close(reply)
+		case <-ticker.C:
+			n.sendDue()
+		}
+	}
+}
+
+func (n *Notifier) sendDue() {
+	for {
+		userIDs, err := n.repository.ClaimDueDigests(claimBatch)
+		if err != nil {
+			logger.Error("[notifier] Cannot claim due digests: %s\n", err)
+			return
+		}
+
+		for _, userID := range userIDs {
+			n.sendDigest(userID)
+		}
+
+		if len(userIDs) < claimBatch {
+			return
+		}
+	}
+}
+
+type digestEntry struct {
+	Type   string
+	Author string
+	Text   string
+	Time   string
+}
+
+// sendDigest enqueues the digest of the user and only then removes its items. If that fails, the items stay
+// queued and the digest is retried after the digest window.
+func (n *Notifier) sendDigest(userID string) {
+	log := logger.With("user_id", userID)
+
+	items, err := n.repository.GetDigestItems(userID)
+	if err == nil {
+		err = n.enqueueDigest(log, userID, items)
+	}
+	if err != nil {
+		log.Error("[notifier] %s, retrying in %s\n", err, n.digestWindow)
+		if err := n.repository.ScheduleDigest(userID, time.Now().Add(n.digestWindow)); err != nil {
+			log.Error("[notifier] Cannot reschedule digest: %s\n", err)
+		}
+		return
+	}
+
+	if err := n.repository.RemoveDigestItems(userID, len(items)); err != nil {
+		log.Error("[notifier] Cannot remove sent digest items: %s\n", err)
+	}
+}
+
+// enqueueDigest returns nil once the items are done with, sent or skipped, and an error if they should be
+// retried.
+func (n *Notifier) enqueueDigest(log *logger.Logger, userID string, items []models.DigestItem) error {
+	// the user came back and has seen the messages in the chat
+	if n.online.IsUserOnline(userID) {
+		digestsSkipped.WithLabelValues("online").Inc()
+		return nil
+	}
+
+	user, err := n.users.GetUser(userID)
+	switch {
+	case errors.Is(err, db.UserNotFound):
+		digestsSkipped.WithLabelValues("no_user").Inc()
+		return nil
+	case err != nil:
+		return fmt.Errorf("cannot get user: %w", err)
+	}
+
+	// preferences may have changed while the items were waiting
+	preferences, err := n.repository.GetNotificationPreferences(userID)
+	if err != nil {
+		return fmt.Errorf("cannot get notification preferences: %w", err)
+	}
+
+	authors := make(map[string]string)
+	entries := make([]digestEntry, 0, len(items))
+	for _, item := range items {
+		if !wants(preferences, item.Type) {
+			continue
+		}
+
+		if _, ok := authors[item.AuthorID]; !ok {
+			authors[item.AuthorID] = item.AuthorID
+			if author, err := n.users.GetUser(item.AuthorID); err == nil {
+				authors[item.AuthorID] = author.Name
+			}
+		}
+
+		entries = append(entries, digestEntry{
+			Type:   item.Type,
+			Author: authors[item.AuthorID],
+			Text:   item.Text,
+			Time:   time.Unix(int64(item.CreatedAt), 0).UTC().Format("2006-01-02 15:04 MST"),
+		})
+	}
+	if len(entries) == 0 {
+		digestsSkipped.WithLabelValues("empty").Inc()
+		return nil
+	}
+
+	unsubscribeLink := n.UnsubscribeLink(userID, UnsubscribeAll)
+	message, err := n.mailer.Render(mailer.NotificationDigestTemplate, n.locale, mail.Address{Name: user.Name, Address: user.Email},
+		map[string]interface{}{
+			"Username":        user.Username,
+			"Entries":         entries,
+			"Link":            n.publicHost,
+			"UnsubscribeLink": unsubscribeLink,
+		})
+	if err != nil {
+		return err
+	}
+	// RFC 8058 one-click unsubscribe from the mail client
+	message.Headers = map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribeLink + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+
+	if err := n.mailer.Enqueue(message); err != nil {
+		return fmt.Errorf("cannot enqueue digest: %w", err)
+	}
+
+	digestsSent.Inc()
+	log.Info("[notifier] Digest with %d notifications enqueued\n", len(entries))
+
+	return nil
+}
+
+// Ping checks that the Run loop is alive.
+func (n *Notifier) Ping(timeout time.Duration) error {
+	reply := make(chan struct{})
+	select {
+	case n.ping <- reply:
+	case <-time.After(timeout):
+		return NotifierNotRunning
+	}
+
+	select {
+	case <-reply:
+		return nil
+	case <-time.After(timeout):
+		return NotifierNotRunning
+	}
+}
+
+func wants(preferences models.NotificationPreferences, itemType string) bool {
+	switch itemType {
+	case models.DigestMention:
+		return preferences.Mentions
+	case models.DigestDirectMessage:
+		return preferences.DirectMessages
+	}
+
+	return false
+}
+
+func excerpt(text string) string {
+	if utf8.RuneCountInString(text) <= maxExcerptLength {
+		return text
+	}
+
+	runes := []rune(text)
+	return string(runes[:maxExcerptLength]) + "…"
+}
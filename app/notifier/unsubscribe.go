@@ -0,0 +1,63 @@
+package notifier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/mazanax/go-chat/app/models"
+	"net/url"
+	"strings"
+)
+
+// What an unsubscribe link turns off.
+const (
+	UnsubscribeMentions       = "mentions"
+	UnsubscribeDirectMessages = "direct_messages"
+	UnsubscribeAll            = "all"
+)
+
+// UnsubscribeLink returns the link put into digests. It works without logging in, the signature proves that it
+// was sent to the owner of the mailbox.
+func (n *Notifier) UnsubscribeLink(userID string, kind string) string {
+	query := url.Values{}
+	query.Set("user", userID)
+	query.Set("kind", kind)
+	query.Set("signature", n.sign(userID, kind))
+
+	return strings.TrimRight(n.publicHost, "/") + "/api/unsubscribe?" + query.Encode()
+}
+
+// VerifyUnsubscribe checks the signature of an unsubscribe link.
+func (n *Notifier) VerifyUnsubscribe(userID string, kind string, signature string) bool {
+	switch kind {
+	case UnsubscribeMentions, UnsubscribeDirectMessages, UnsubscribeAll:
+	default:
+		return false
+	}
+
+	return hmac.Equal([]byte(n.sign(userID, kind)), []byte(signature))
+}
+
+// Unsubscribe turns off the notifications of the given kind.
+func (n *Notifier) Unsubscribe(userID string, kind string) (models.NotificationPreferences, error) {
+	preferences, err := n.repository.GetNotificationPreferences(userID)
+	if err != nil {
+		return models.NotificationPreferences{}, err
+	}
+
+	if kind == UnsubscribeMentions || kind == UnsubscribeAll {
+		preferences.Mentions = false
+	}
+	if kind == UnsubscribeDirectMessages || kind == UnsubscribeAll {
+		preferences.DirectMessages = false
+	}
+
+	return preferences, n.repository.SetNotificationPreferences(userID, preferences)
+}
+
+func (n *Notifier) sign(userID string, kind string) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write([]byte("unsubscribe\n" + userID + "\n" + kind))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -3,6 +3,7 @@ package requests
 import (
 	"gopkg.in/go-playground/validator.v9"
 	"regexp"
+	"time"
 )
 
 var (
@@ -14,6 +15,11 @@ func Validate(request interface{}) []string {
 	_ = v.RegisterValidation("slug", func(fl validator.FieldLevel) bool {
 		return slugRegex.MatchString(fl.Field().String())
 	})
+	// IANA names such as Europe/Moscow
+	_ = v.RegisterValidation("timezone", func(fl validator.FieldLevel) bool {
+		_, err := time.LoadLocation(fl.Field().String())
+		return err == nil && fl.Field().String() != "Local"
+	})
 	err := v.Struct(request)
 
 	var validationErrors []string
@@ -0,0 +1,104 @@
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// words shorter than this are not indexed, they match too many messages to be useful
+const minTermLength = 2
+
+// Tokenize splits the text into unique case-folded terms: runs of letters and digits, in order of appearance.
+func Tokenize(text string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(text, isSeparator) {
+		term := strings.ToLower(word)
+		if utf8.RuneCountInString(term) < minTermLength || seen[term] {
+			continue
+		}
+
+		seen[term] = true
+		terms = append(terms, term)
+	}
+
+	return terms
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Snippet returns an HTML fragment of at most about width runes around the first matching term, with every
+// match wrapped in <mark>. The rest of the text is escaped.
+func Snippet(text string, terms []string, width int) string {
+	matching := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		matching[term] = true
+	}
+
+	runes := []rune(text)
+	type span struct{ start, end int }
+	var matches []span
+	for start := 0; start < len(runes); {
+		if isSeparator(runes[start]) {
+			start++
+			continue
+		}
+
+		end := start
+		for end < len(runes) && !isSeparator(runes[end]) {
+			end++
+		}
+		if matching[strings.ToLower(string(runes[start:end]))] {
+			matches = append(matches, span{start, end})
+		}
+		start = end
+	}
+
+	from, to := 0, len(runes)
+	if len(runes) > width {
+		if len(matches) > 0 {
+			from = matches[0].start - width/4
+		}
+		if from < 0 {
+			from = 0
+		}
+		to = from + width
+		if to > len(runes) {
+			to, from = len(runes), len(runes)-width
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	position := from
+	for _, match := range matches {
+		if match.end <= from || match.start >= to {
+			continue
+		}
+
+		start, end := match.start, match.end
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+		b.WriteString(html.EscapeString(string(runes[position:start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[start:end])))
+		b.WriteString("</mark>")
+		position = end
+	}
+	b.WriteString(html.EscapeString(string(runes[position:to])))
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+
+	return b.String()
+}
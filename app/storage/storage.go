@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	BlobNotFound   = fmt.Errorf("blob not found")
+	InvalidBlobKey = fmt.Errorf("invalid blob key")
+)
+
+// BlobStore keeps the content of uploaded files. Metadata is stored separately, see db.UploadRepository.
+type BlobStore interface {
+	// Put stores the content under the key, replacing the previous one, and returns its size.
+	Put(key string, content io.Reader) (int64, error)
+	// Open returns BlobNotFound for unknown keys. The reader may implement io.ReadSeeker.
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// keys are generated by the server, anything else is refused so that no key escapes the directory
+var keyPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// LocalBlobStore keeps blobs as files in a directory, sharded by the first two characters of the key.
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create blob directory: %w", err)
+	}
+
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func (store *LocalBlobStore) Put(key string, content io.Reader) (int64, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// write to tmp and move into place, so readers never see a partial file
+	tmp, err := ioutil.TempFile(filepath.Join(store.dir, "tmp"), "blob-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	size, err := io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+
+	return size, os.Rename(tmp.Name(), path)
+}
+
+func (store *LocalBlobStore) Open(key string) (io.ReadCloser, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, BlobNotFound
+	}
+
+	return file, err
+}
+
+func (store *LocalBlobStore) Delete(key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (store *LocalBlobStore) path(key string) (string, error) {
+	if len(key) < 2 || !keyPattern.MatchString(key) {
+		return "", InvalidBlobKey
+	}
+
+	return filepath.Join(store.dir, key[:2], key), nil
+}
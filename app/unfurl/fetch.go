@@ -0,0 +1,221 @@
+package unfurl
+
+import (
+	"context"
+	"fmt"
+	"github.com/mazanax/go-chat/app/models"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	userAgent    = "go-chat link preview"
+	maxRedirects = 3
+	// longer titles and descriptions are cut
+	maxTitleLength       = 200
+	maxDescriptionLength = 300
+	maxImageURLLength    = 2048
+)
+
+var (
+	BlockedAddress = fmt.Errorf("address is not public")
+	NotHTML        = fmt.Errorf("page is not HTML")
+)
+
+// blockedNetworks are the loopback, private, link-local, shared and reserved ranges. Nobody may make the server
+// fetch from them, or from the cloud metadata endpoints among them.
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+var (
+	headEndPattern   = regexp.MustCompile(`(?i)</head\s*>`)
+	titlePattern     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title\s*>`)
+	metaPattern      = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attributePattern = regexp.MustCompile(`(?s)([a-zA-Z:_-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func isBlocked(ip net.IP) bool {
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newClient checks the address of every connection, redirects included, once the host name is resolved, so
+// that neither a redirect nor DNS pointing at an internal address gets around the check.
+func newClient(timeout time.Duration, allowPrivateNetworks bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivateNetworks {
+		dialer.Control = func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlocked(ip) {
+				return BlockedAddress
+			}
+
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			// no proxy from the environment, it would connect on our behalf without the check above
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          16,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		Timeout: timeout,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to %s URL", r.URL.Scheme)
+			}
+
+			return nil
+		},
+	}
+}
+
+// fetch reads the head of the page for its preview.
+func (u *Unfurler) fetch(ctx context.Context, target string) (models.LinkPreview, error) {
+	defer fetchDuration.ObserveSince(time.Now())
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return models.LinkPreview{}, err
+	}
+	request.Header.Set("User-Agent", userAgent)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		return models.LinkPreview{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return models.LinkPreview{}, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return models.LinkPreview{}, NotHTML
+	}
+
+	page, err := ioutil.ReadAll(io.LimitReader(response.Body, u.maxPageSize))
+	if err != nil {
+		return models.LinkPreview{}, err
+	}
+
+	preview := parsePage(string(page), response.Request.URL)
+	preview.URL = target
+
+	return preview, nil
+}
+
+// parsePage takes the preview from the OpenGraph tags, then from the Twitter card and the usual title and
+// description. Pages are expected in UTF-8, other encodings may come out garbled but never invalid.
+func parsePage(page string, base *url.URL) models.LinkPreview {
+	if end := headEndPattern.FindStringIndex(page); end != nil {
+		page = page[:end[0]]
+	}
+
+	meta := make(map[string]string)
+	for _, tag := range metaPattern.FindAllString(page, -1) {
+		attributes := make(map[string]string)
+		for _, match := range attributePattern.FindAllStringSubmatch(tag, -1) {
+			attributes[strings.ToLower(match[1])] = strings.Trim(match[2], `"'`)
+		}
+
+		name := attributes["property"]
+		if len(name) == 0 {
+			name = attributes["name"]
+		}
+		name = strings.ToLower(name)
+		if _, ok := meta[name]; !ok && len(name) > 0 {
+			meta[name] = attributes["content"]
+		}
+	}
+
+	title := first(meta["og:title"], meta["twitter:title"])
+	if match := titlePattern.FindStringSubmatch(page); len(title) == 0 && match != nil {
+		title = match[1]
+	}
+
+	return models.LinkPreview{
+		Title:       clean(title, maxTitleLength),
+		Description: clean(first(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescriptionLength),
+		ImageURL:    resolve(base, first(meta["og:image"], meta["og:image:url"], meta["twitter:image"])),
+		SiteName:    clean(meta["og:site_name"], maxTitleLength),
+	}
+}
+
+func first(values ...string) string {
+	for _, value := range values {
+		if len(strings.TrimSpace(value)) > 0 {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func clean(text string, maxLength int) string {
+	text = strings.ToValidUTF8(html.UnescapeString(text), "")
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) > maxLength {
+		text = string([]rune(text)[:maxLength-1]) + "…"
+	}
+
+	return text
+}
+
+// resolve returns the absolute URL of an image, which clients load on their own; only http(s) URLs are kept.
+func resolve(base *url.URL, reference string) string {
+	reference = strings.TrimSpace(html.UnescapeString(reference))
+	if len(reference) == 0 || len(reference) > maxImageURLLength {
+		return ""
+	}
+
+	resolved, err := base.Parse(reference)
+	if err != nil || (resolved.Scheme != "http" && resolved.Scheme != "https") {
+		return ""
+	}
+
+	return resolved.String()
+}
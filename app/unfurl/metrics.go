@@ -0,0 +1,20 @@
+package unfurl
+
+import "github.com/mazanax/go-chat/app/metrics"
+
+var (
+	linksUnfurled = metrics.NewCounterVec(
+		"chat_unfurl_links_total",
+		"Links looked up by the unfurler, by result.",
+		"result",
+	)
+	messagesSkipped = metrics.NewCounter(
+		"chat_unfurl_messages_skipped_total",
+		"Messages with links which were not unfurled because the queue was full.",
+	)
+	fetchDuration = metrics.NewHistogram(
+		"chat_unfurl_fetch_duration_seconds",
+		"Time taken to fetch a page for its preview.",
+		metrics.DefaultBuckets,
+	)
+)
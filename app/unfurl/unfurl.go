@@ -0,0 +1,248 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/mazanax/go-chat/app/db"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/markdown"
+	"github.com/mazanax/go-chat/app/models"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// links after these are not previewed
+	maxLinks = 3
+	// messages waiting for the workers, more are not unfurled
+	queueSize = 256
+	// failed fetches are retried after this long at the earliest
+	failureTTL = 10 * time.Minute
+)
+
+var UnfurlerNotRunning = fmt.Errorf("unfurler is not running")
+
+type Config struct {
+	// fetches running at once
+	Workers int
+	// limit of a fetch, redirects included
+	Timeout time.Duration
+	// pages are read up to this many bytes, the head is usually within the first few kilobytes
+	MaxPageSize int64
+	// how long a preview, or the lack of one, is kept
+	CacheTTL time.Duration
+	// lets the unfurler fetch from loopback and private addresses, for development only
+	AllowPrivateNetworks bool
+}
+
+// Unfurler fetches previews of the links in stored messages in the background, attaches them to the message
+// and announces them with a PreviewsAttached notification.
+type Unfurler struct {
+	repository db.LinkPreviewRepository
+	client     *http.Client
+
+	workers     int
+	maxPageSize int64
+	cacheTTL    time.Duration
+
+	queue chan models.Message
+	// the hub publishes everything sent here
+	notifications chan *models.Message
+	// liveness probes, Run closes every received channel
+	ping chan chan struct{}
+}
+
+func New(config Config, repository db.LinkPreviewRepository, notifications chan *models.Message) *Unfurler {
+	return &Unfurler{
+		repository: repository,
+		client:     newClient(config.Timeout, config.AllowPrivateNetworks),
+
+		workers:     config.Workers,
+		maxPageSize: config.MaxPageSize,
+		cacheTTL:    config.CacheTTL,
+
+		queue:         make(chan models.Message, queueSize),
+		notifications: notifications,
+		ping:          make(chan chan struct{}),
+	}
+}
+
+// MessageStored queues the message if it links to something. It never blocks the hub: when the workers lag
+// behind, the message goes without previews.
+func (u *Unfurler) MessageStored(message models.Message) {
+	if (message.Type != models.RegularMessage && message.Type != models.ActionMessage) || len(links(message.Markup)) == 0 {
+		return
+	}
+
+	select {
+	case u.queue <- message:
+	default:
+		messagesSkipped.Inc()
+		logger.With("message_id", message.ID).Warn("[unfurl] Queue is full, message skipped\n")
+	}
+}
+
+// DirectMessageSent does nothing: previews are announced to everybody, so links in direct messages are not
+// unfurled.
+func (u *Unfurler) DirectMessageSent(models.Message, string) {}
+
+// Run unfurls queued messages until the context is cancelled.
+func (u *Unfurler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < u.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message := <-u.queue:
+					u.unfurl(ctx, message)
+				}
+			}
+		}()
+	}
+	defer func() {
+		wg.Wait()
+		logger.Info("[unfurl] Stopped\n")
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reply := <-u.ping:
+			close(reply)
+		}
+	}
+}
+
+func (u *Unfurler) unfurl(ctx context.Context, message models.Message) {
+	log := logger.With("message_id", message.ID)
+
+	var previews []models.LinkPreview
+	for _, link := range links(message.Markup) {
+		preview, ok := u.preview(ctx, link)
+		if ok {
+			previews = append(previews, preview)
+		}
+	}
+	if len(previews) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	err := u.repository.SetMessagePreviews(message.ID, previews)
+	switch {
+	case errors.Is(err, db.MessageNotFound):
+		log.Debug("[unfurl] Message was deleted before its previews were ready\n")
+		return
+	case err != nil:
+		log.Error("[unfurl] Cannot attach previews: %s\n", err)
+		return
+	}
+
+	notification := &models.Message{
+		ID:        uuid.NewString(),
+		UserID:    message.UserID,
+		Type:      models.PreviewsAttached,
+		Data:      models.JsonMessagePreviews{MessageID: message.ID, Previews: models.MapPreviewsToJson(previews)},
+		CreatedAt: int(time.Now().Unix()),
+	}
+	select {
+	case u.notifications <- notification:
+	case <-ctx.Done():
+	}
+}
+
+// preview returns the cached preview of the link or fetches it. It returns false if the page has nothing to
+// show or could not be fetched.
+func (u *Unfurler) preview(ctx context.Context, link string) (models.LinkPreview, bool) {
+	log := logger.With("url", link)
+
+	preview, err := u.repository.GetLinkPreview(link)
+	switch {
+	case err == nil:
+		linksUnfurled.WithLabelValues("cached").Inc()
+		return preview, !isEmpty(preview)
+	case !errors.Is(err, db.LinkPreviewNotFound):
+		log.Error("[unfurl] Cannot get cached preview: %s\n", err)
+		return models.LinkPreview{}, false
+	}
+
+	ttl := u.cacheTTL
+	preview, err = u.fetch(ctx, link)
+	switch {
+	case ctx.Err() != nil:
+		return models.LinkPreview{}, false
+	case errors.Is(err, BlockedAddress):
+		linksUnfurled.WithLabelValues("blocked").Inc()
+		log.Warn("[unfurl] Link to a non-public address\n")
+		preview = models.LinkPreview{}
+	case errors.Is(err, NotHTML):
+		linksUnfurled.WithLabelValues("not_html").Inc()
+	case err != nil:
+		linksUnfurled.WithLabelValues("failed").Inc()
+		log.Debug("[unfurl] Cannot fetch preview: %s\n", err)
+		preview, ttl = models.LinkPreview{}, failureTTL
+	case isEmpty(preview):
+		linksUnfurled.WithLabelValues("empty").Inc()
+	default:
+		linksUnfurled.WithLabelValues("fetched").Inc()
+	}
+
+	// pages without a preview are cached too, so that they are not fetched for every message
+	preview.URL = link
+	if err := u.repository.CacheLinkPreview(preview, ttl); err != nil {
+		log.Error("[unfurl] Cannot cache preview: %s\n", err)
+	}
+
+	return preview, !isEmpty(preview)
+}
+
+// Ping checks that the Run loop is alive.
+func (u *Unfurler) Ping(timeout time.Duration) error {
+	reply := make(chan struct{})
+	select {
+	case u.ping <- reply:
+	case <-time.After(timeout):
+		return UnfurlerNotRunning
+	}
+
+	select {
+	case <-reply:
+		return nil
+	case <-time.After(timeout):
+		return UnfurlerNotRunning
+	}
+}
+
+// links returns the distinct http(s) URLs linked from the markup of a text, the ones in code excluded.
+func links(markup []markdown.Node) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	var walk func(nodes []markdown.Node)
+	walk = func(nodes []markdown.Node) {
+		for _, node := range nodes {
+			if len(urls) == maxLinks {
+				return
+			}
+			if node.Type == markdown.Link && strings.HasPrefix(node.URL, "http") && !seen[node.URL] {
+				seen[node.URL] = true
+				urls = append(urls, node.URL)
+			}
+			walk(node.Children)
+		}
+	}
+	walk(markup)
+
+	return urls
+}
+
+func isEmpty(preview models.LinkPreview) bool {
+	return len(preview.Title) == 0 && len(preview.Description) == 0
+}
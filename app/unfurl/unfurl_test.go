@@ -0,0 +1,367 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mazanax/go-chat/app/db"
+	"github.com/mazanax/go-chat/app/markdown"
+	"github.com/mazanax/go-chat/app/models"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// previewCache is an in-memory LinkPreviewRepository.
+type previewCache struct {
+	mu       sync.Mutex
+	previews map[string]models.LinkPreview
+	attached map[string][]models.LinkPreview
+}
+
+func newPreviewCache() *previewCache {
+	return &previewCache{previews: make(map[string]models.LinkPreview), attached: make(map[string][]models.LinkPreview)}
+}
+
+func (c *previewCache) GetLinkPreview(url string) (models.LinkPreview, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	preview, ok := c.previews[url]
+	if !ok {
+		return models.LinkPreview{}, db.LinkPreviewNotFound
+	}
+
+	return preview, nil
+}
+
+func (c *previewCache) CacheLinkPreview(preview models.LinkPreview, _ time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.previews[preview.URL] = preview
+
+	return nil
+}
+
+func (c *previewCache) SetMessagePreviews(messageID string, previews []models.LinkPreview) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attached[messageID] = previews
+
+	return nil
+}
+
+func newTestUnfurler(allowPrivateNetworks bool) (*Unfurler, *previewCache) {
+	cache := newPreviewCache()
+	u := New(Config{
+		Workers:              1,
+		Timeout:              500 * time.Millisecond,
+		MaxPageSize:          4096,
+		CacheTTL:             time.Hour,
+		AllowPrivateNetworks: allowPrivateNetworks,
+	}, cache, make(chan *models.Message, 1))
+
+	return u, cache
+}
+
+func servePage(page string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}))
+}
+
+func TestFetch(t *testing.T) {
+	tests := []struct {
+		name    string
+		page    string
+		preview models.LinkPreview
+	}{
+		{
+			"OpenGraph",
+			`<html><head>
+				<title>Ignored</title>
+				<meta property="og:title" content="The &amp; title">
+				<meta property="og:description" content='A
+					description'>
+				<meta property="og:image" content="/image.png">
+				<meta property="og:site_name" content="Site">
+			</head><body>...</body></html>`,
+			models.LinkPreview{Title: "The & title", Description: "A description", ImageURL: "/image.png", SiteName: "Site"},
+		},
+		{
+			"Twitter card",
+			`<head><meta name="twitter:title" content="Card"><meta name="twitter:description" content="Text"></head>`,
+			models.LinkPreview{Title: "Card", Description: "Text"},
+		},
+		{
+			"title and description",
+			`<HEAD><TITLE> Plain
+				title </TITLE><meta name="description" content="About"></HEAD>`,
+			models.LinkPreview{Title: "Plain title", Description: "About"},
+		},
+		{
+			"tags in the body",
+			`<head></head><body><title>Body</title><meta property="og:title" content="Body"></body>`,
+			models.LinkPreview{},
+		},
+		{
+			"javascript image",
+			`<head><title>T</title><meta property="og:image" content="javascript:alert(1)"></head>`,
+			models.LinkPreview{Title: "T"},
+		},
+		{
+			"long title",
+			`<head><title>` + strings.Repeat("a", 300) + `</title></head>`,
+			models.LinkPreview{Title: strings.Repeat("a", maxTitleLength-1) + "…"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := servePage(test.page)
+			defer server.Close()
+
+			u, _ := newTestUnfurler(true)
+			preview, err := u.fetch(context.Background(), server.URL+"/page")
+			if err != nil {
+				t.Fatalf("fetch: %s", err)
+			}
+
+			test.preview.URL = server.URL + "/page"
+			if strings.HasPrefix(test.preview.ImageURL, "/") {
+				test.preview.ImageURL = server.URL + test.preview.ImageURL
+			}
+			if preview != test.preview {
+				t.Errorf("fetch gives %+v, want %+v", preview, test.preview)
+			}
+		})
+	}
+}
+
+func TestFetchNotHTML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"title": "no"}`)
+	}))
+	defer server.Close()
+
+	u, _ := newTestUnfurler(true)
+	if _, err := u.fetch(context.Background(), server.URL); !errors.Is(err, NotHTML) {
+		t.Errorf("fetch gives %v, want %v", err, NotHTML)
+	}
+}
+
+func TestFetchMaxPageSize(t *testing.T) {
+	u, _ := newTestUnfurler(true)
+
+	// the title comes after the bytes which are read
+	server := servePage("<head><!--" + strings.Repeat("x", int(u.maxPageSize)) + "--><title>Late</title></head>")
+	defer server.Close()
+
+	preview, err := u.fetch(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if len(preview.Title) > 0 {
+		t.Errorf("title %q was read past the limit", preview.Title)
+	}
+
+	// an endless page is cut too, fetch returning at all shows it
+	endless := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<head><title>Endless</title>")
+		chunk := []byte(strings.Repeat("x", 1024))
+		for r.Context().Err() == nil {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer endless.Close()
+
+	preview, err = u.fetch(context.Background(), endless.URL)
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if preview.Title != "Endless" {
+		t.Errorf("fetch gives title %q, want %q", preview.Title, "Endless")
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	u, _ := newTestUnfurler(true)
+	start := time.Now()
+	_, err := u.fetch(context.Background(), server.URL)
+	if err == nil {
+		t.Fatal("fetch of a page which never answers succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fetch gave up after %s, the timeout is %s", elapsed, u.client.Timeout)
+	}
+
+	// a slow body is cut by the same timeout
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<head>")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	start = time.Now()
+	if _, err := u.fetch(context.Background(), slow.URL); err == nil {
+		t.Fatal("fetch of a page which never ends succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fetch gave up after %s, the timeout is %s", elapsed, u.client.Timeout)
+	}
+}
+
+func TestFetchBlockedAddresses(t *testing.T) {
+	u, _ := newTestUnfurler(false)
+
+	for _, target := range []string{
+		"http://127.0.0.1/",
+		"http://127.1.2.3:8080/",
+		"http://localhost/",
+		"http://10.0.0.1/",
+		"http://172.16.0.1/",
+		"http://192.168.1.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://100.64.0.1/",
+		"http://0.0.0.0/",
+		"http://[::1]/",
+		"http://[fe80::1]/",
+		"http://[fd00::1]/",
+		"http://[::ffff:127.0.0.1]/",
+	} {
+		if _, err := u.fetch(context.Background(), target); !errors.Is(err, BlockedAddress) {
+			t.Errorf("fetch(%s) gives %v, want %v", target, err, BlockedAddress)
+		}
+	}
+}
+
+func TestFetchBlockedRedirect(t *testing.T) {
+	internal := servePage("<head><title>Internal</title></head>")
+	defer internal.Close()
+	// the address of the internal server, and the port on 127.0.0.1 in particular
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(internal.URL, "http://"))
+
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://127.0.0.1:"+port+"/", http.StatusFound)
+	}))
+	defer public.Close()
+
+	u, _ := newTestUnfurler(false)
+	// the public server is on loopback too, the test lets only its host name through unchecked
+	transport := u.client.Transport.(*http.Transport)
+	checked := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if address == "public.test:80" {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, strings.TrimPrefix(public.URL, "http://"))
+		}
+		return checked(ctx, network, address)
+	}
+
+	if _, err := u.fetch(context.Background(), "http://public.test/"); !errors.Is(err, BlockedAddress) {
+		t.Errorf("fetch after a redirect to 127.0.0.1 gives %v, want %v", err, BlockedAddress)
+	}
+}
+
+func TestPreviewCache(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<head><title>Fetched</title></head>")
+	}))
+	defer server.Close()
+
+	u, cache := newTestUnfurler(true)
+
+	cached := server.URL + "/cached"
+	_ = cache.CacheLinkPreview(models.LinkPreview{URL: cached, Title: "Cached"}, time.Hour)
+	preview, ok := u.preview(context.Background(), cached)
+	if !ok || preview.Title != "Cached" {
+		t.Errorf("preview of a cached link gives %+v, %v", preview, ok)
+	}
+	if n := atomic.LoadInt64(&requests); n != 0 {
+		t.Errorf("a cached link was fetched %d times", n)
+	}
+
+	// an empty preview stands for a page without one, it is not fetched again either
+	empty := server.URL + "/empty"
+	_ = cache.CacheLinkPreview(models.LinkPreview{URL: empty}, time.Hour)
+	if _, ok := u.preview(context.Background(), empty); ok {
+		t.Error("preview of a link cached without one is shown")
+	}
+	if n := atomic.LoadInt64(&requests); n != 0 {
+		t.Errorf("a link cached without a preview was fetched %d times", n)
+	}
+
+	fresh := server.URL + "/fresh"
+	for i := 0; i < 2; i++ {
+		preview, ok = u.preview(context.Background(), fresh)
+		if !ok || preview.Title != "Fetched" {
+			t.Errorf("preview of a new link gives %+v, %v", preview, ok)
+		}
+	}
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("a link was fetched %d times, want once", n)
+	}
+}
+
+func TestUnfurl(t *testing.T) {
+	server := servePage(`<head><meta property="og:title" content="Page"></head>`)
+	defer server.Close()
+
+	u, cache := newTestUnfurler(true)
+	message := models.Message{ID: "m1", Type: models.RegularMessage, Text: "see " + server.URL + " and `" + server.URL + "/code`"}
+	message.Render()
+	if got := links(message.Markup); len(got) != 1 || got[0] != server.URL {
+		t.Fatalf("links gives %v, want [%s]", got, server.URL)
+	}
+
+	u.unfurl(context.Background(), message)
+
+	if previews := cache.attached["m1"]; len(previews) != 1 || previews[0].Title != "Page" {
+		t.Errorf("attached previews are %+v", previews)
+	}
+	select {
+	case notification := <-u.notifications:
+		data := notification.Data.(models.JsonMessagePreviews)
+		if notification.Type != models.PreviewsAttached || data.MessageID != "m1" || len(data.Previews) != 1 {
+			t.Errorf("notification is %+v", notification)
+		}
+	default:
+		t.Error("no notification was sent")
+	}
+}
+
+func TestLinks(t *testing.T) {
+	text := "https://a.com https://b.com https://a.com [c](https://c.com) https://d.com"
+	got := links(markdown.Parse(text))
+	want := []string{"https://a.com", "https://b.com", "https://c.com"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("links(%q) gives %v, want %v", text, got, want)
+	}
+}
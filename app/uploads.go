@@ -0,0 +1,281 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mazanax/go-chat/app/db"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/media"
+	"github.com/mazanax/go-chat/app/metrics"
+	"github.com/mazanax/go-chat/app/models"
+	"github.com/mazanax/go-chat/app/storage"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// room for the multipart framing around the file
+const multipartOverhead = 64 << 10
+
+var (
+	uploadsStored = metrics.NewCounterVec(
+		"chat_uploads_total",
+		"Files uploaded, by sniffed content type.",
+		"content_type",
+	)
+	uploadedBytes = metrics.NewCounter(
+		"chat_uploaded_bytes_total",
+		"Size of all uploaded files.",
+	)
+)
+
+// region UploadHandlers
+
+// UploadHandler stores the "file" part of a multipart form. The type is sniffed from the content, the name
+// and the Content-Type sent by the client are not trusted.
+func (app *App) UploadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+		user, err := app.currentUser(r)
+		if err != nil {
+			log.Debug("[http] Unauthorized\n")
+			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, int64(app.uploadMaxSize)+multipartOverhead)
+		part, err := filePart(r)
+		if err != nil {
+			log.Debug("[http] Bad request: %s\n", err)
+			sendResponse(w, models.ErrorResponse{
+				Message: "Multipart form with a file part is required",
+				Code:    http.StatusBadRequest,
+			}, http.StatusBadRequest)
+			return
+		}
+		defer func() { _ = part.Close() }()
+
+		head := make([]byte, 512)
+		n, err := io.ReadFull(part, head)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			log.Debug("[http] Cannot read upload: %s\n", err)
+			sendResponse(w, models.ErrorResponse{Code: http.StatusBadRequest}, http.StatusBadRequest)
+			return
+		}
+		head = head[:n]
+
+		contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+		if !app.uploadAllowedTypes[contentType] {
+			log.Debug("[http] File type %s is not allowed\n", contentType)
+			sendResponse(w, models.UnsupportedFileType, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		upload := models.Upload{
+			ID:          uuid.NewString(),
+			UserID:      user.ID,
+			Name:        uploadName(part.FileName()),
+			ContentType: contentType,
+			CreatedAt:   int(time.Now().Unix()),
+		}
+
+		// one byte more than allowed tells a file of the maximal size from a larger one
+		content := io.LimitReader(io.MultiReader(bytes.NewReader(head), part), int64(app.uploadMaxSize)+1)
+		size, err := app.blobStore.Put(upload.ID, content)
+		if err == nil && size > int64(app.uploadMaxSize) {
+			_ = app.blobStore.Delete(upload.ID)
+			log.Debug("[http] File is larger than %d bytes\n", app.uploadMaxSize)
+			sendResponse(w, models.FileTooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			_ = app.blobStore.Delete(upload.ID)
+			log.Error("[http] Cannot store upload: %s\n", err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+		upload.Size = int(size)
+
+		if media.IsImage(contentType) {
+			app.makeThumbnail(&upload)
+		}
+
+		if err := app.UploadRepository.CreateUpload(upload); err != nil {
+			_ = app.blobStore.Delete(upload.ID)
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		uploadsStored.WithLabelValues(contentType).Inc()
+		uploadedBytes.Add(float64(size))
+		log.With("upload_id", upload.ID, "content_type", contentType, "size", size).Info("[http] File uploaded\n")
+		sendResponse(w, models.MapUploadToJson(upload), http.StatusCreated)
+	}
+}
+
+// DownloadHandler serves an uploaded file, or its thumbnail, to logged in users.
+func (app *App) DownloadHandler(thumbnail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logger.FromContext(r.Context())
+		log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+		if _, err := app.currentUser(r); err != nil {
+			log.Debug("[http] Unauthorized\n")
+			sendResponse(w, models.Unauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		upload, err := app.UploadRepository.GetUpload(id)
+		switch {
+		case errors.Is(err, db.UploadNotFound) || (thumbnail && err == nil && !upload.HasThumbnail):
+			log.Debug("[http] Upload #%s not found\n", id)
+			sendResponse(w, models.NotFound, http.StatusNotFound)
+			return
+		case err != nil:
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+
+		key, contentType := upload.ID, upload.ContentType
+		if thumbnail {
+			key, contentType = thumbnailKey(upload.ID), thumbnailContentType(upload.ContentType)
+		}
+
+		content, err := app.blobStore.Open(key)
+		switch {
+		case errors.Is(err, storage.BlobNotFound):
+			log.Warn("[http] Content of upload #%s is missing\n", id)
+			sendResponse(w, models.NotFound, http.StatusNotFound)
+			return
+		case err != nil:
+			log.Error("[http] Unexpected error: %s %s %s\n", r.Method, r.URL, err)
+			sendResponse(w, models.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+		defer func() { _ = content.Close() }()
+
+		// only images are shown inline, and nothing served from here may run scripts
+		disposition := "attachment"
+		if media.IsImage(upload.ContentType) {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": upload.Name}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+
+		if seeker, ok := content.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, "", time.Unix(int64(upload.CreatedAt), 0), seeker)
+			return
+		}
+		_, _ = io.Copy(w, content)
+	}
+}
+
+// endregion
+
+// filePart returns the "file" part of the multipart body.
+func filePart(r *http.Request) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		_ = part.Close()
+	}
+}
+
+// makeThumbnail stores a thumbnail of the uploaded image. Images which cannot be decoded are kept as plain files.
+func (app *App) makeThumbnail(upload *models.Upload) {
+	log := logger.With("upload_id", upload.ID)
+
+	content, err := app.blobStore.Open(upload.ID)
+	if err != nil {
+		log.Error("[uploads] Cannot open image: %s\n", err)
+		return
+	}
+	config, err := media.DecodeConfig(content)
+	_ = content.Close()
+	if err != nil {
+		log.Debug("[uploads] No thumbnail: %s\n", err)
+		return
+	}
+	upload.Width, upload.Height = config.Width, config.Height
+
+	content, err = app.blobStore.Open(upload.ID)
+	if err != nil {
+		log.Error("[uploads] Cannot open image: %s\n", err)
+		return
+	}
+	release := media.Acquire()
+	defer release()
+	img, err := media.Decode(content)
+	_ = content.Close()
+	if err != nil {
+		log.Debug("[uploads] No thumbnail: %s\n", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := media.Encode(&buf, media.Fit(img, app.thumbnailSize), thumbnailContentType(upload.ContentType)); err != nil {
+		log.Error("[uploads] Cannot encode thumbnail: %s\n", err)
+		return
+	}
+	if _, err := app.blobStore.Put(thumbnailKey(upload.ID), &buf); err != nil {
+		log.Error("[uploads] Cannot store thumbnail: %s\n", err)
+		return
+	}
+
+	upload.HasThumbnail = true
+}
+
+func thumbnailKey(uploadID string) string {
+	return uploadID + ".thumbnail"
+}
+
+// thumbnailContentType keeps photos in JPEG, other images may have transparency and become PNG.
+func thumbnailContentType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+
+	return "image/png"
+}
+
+// uploadName keeps the base name sent by the client, it is only used in Content-Disposition.
+func uploadName(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if !utf8.ValidString(name) || name == "." || name == "/" || len(name) == 0 {
+		return "file"
+	}
+	if len(name) > 255 {
+		name = name[:255]
+		// do not leave half of a character at the end
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+
+	return name
+}
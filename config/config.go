@@ -0,0 +1,296 @@
+package config
+
+import (
+	"fmt"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/security"
+	"strings"
+	"time"
+)
+
+// placeholderSecret is the secret of config.toml.dist and .env.dist. It is long enough, but known to everybody.
+const placeholderSecret = "change-me-to-a-long-random-string"
+
+// Config is the effective configuration of the chat server.
+//
+// Every field is described by tags: `toml` is the key inside its table of the config file, `env` is the
+// environment variable and `flag` is the command line flag overriding it. Fields tagged `secret` are
+// masked when the configuration is printed.
+type Config struct {
+	Server        ServerConfig        `toml:"server"`
+	Websocket     WebsocketConfig     `toml:"websocket"`
+	Redis         RedisConfig         `toml:"redis"`
+	Mailer        MailerConfig        `toml:"mailer"`
+	Notifications NotificationsConfig `toml:"notifications"`
+	Retention     RetentionConfig     `toml:"retention"`
+	Unfurl        UnfurlConfig        `toml:"unfurl"`
+	Uploads       UploadsConfig       `toml:"uploads"`
+	Security      SecurityConfig      `toml:"security"`
+	Audit         AuditConfig         `toml:"audit"`
+	Log           LogConfig           `toml:"log"`
+}
+
+type ServerConfig struct {
+	Host           string   `toml:"host" env:"HOST" flag:"host" usage:"Host to listen to"`
+	Port           int      `toml:"port" env:"PORT" flag:"port" usage:"Port to listen to"`
+	PublicHost     string   `toml:"public_host" env:"PUBLIC_HOST" flag:"public-host" usage:"Public URL used in links sent to users"`
+	AllowedOrigins []string `toml:"allowed_origins" env:"ALLOWED_ORIGINS"`
+	// addresses or CIDR ranges of the reverse proxies whose X-Forwarded-For header is believed
+	TrustedProxies []string `toml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+type WebsocketConfig struct {
+	// permessage-deflate, negotiated with the clients which support it
+	Compression bool `toml:"compression" env:"WEBSOCKET_COMPRESSION"`
+	// largest frame accepted from a client in bytes, and longest message text in characters
+	MaxFrameSize  int `toml:"max_frame_size" env:"WEBSOCKET_MAX_FRAME_SIZE"`
+	MaxTextLength int `toml:"max_text_length" env:"WEBSOCKET_MAX_TEXT_LENGTH"`
+	// number of the newest events kept for reconnecting clients
+	ReplaySize int `toml:"replay_size" env:"WEBSOCKET_REPLAY_SIZE"`
+	// policy for clients which do not keep up: disconnect, drop_oldest or coalesce
+	Backpressure string        `toml:"backpressure" env:"WEBSOCKET_BACKPRESSURE"`
+	MaxLag       time.Duration `toml:"max_lag" env:"WEBSOCKET_MAX_LAG"`
+}
+
+type RedisConfig struct {
+	Addr     string `toml:"addr" env:"REDIS_ADDR" flag:"redis-addr" usage:"Redis address"`
+	Password string `toml:"password" env:"REDIS_PASSWORD" secret:"true"`
+	DB       int    `toml:"db" env:"REDIS_DB" flag:"redis-db" usage:"Redis database"`
+}
+
+type MailerConfig struct {
+	Transport     string `toml:"transport" env:"MAILER_TRANSPORT" flag:"mailer-transport" usage:"Mail transport: tls, starttls, plain, file or log"`
+	TLSSkipVerify bool   `toml:"tls_skip_verify" env:"MAILER_TLS_SKIP_VERIFY"`
+	Dir           string `toml:"dir" env:"MAILER_DIR"`
+
+	Login    string `toml:"login" env:"MAILER_LOGIN"`
+	Sender   string `toml:"sender" env:"MAILER_SENDER"`
+	FromName string `toml:"from_name" env:"MAILER_FROM_NAME"`
+	Password string `toml:"password" env:"MAILER_PASSWORD" secret:"true"`
+	SmtpHost string `toml:"smtp_host" env:"MAILER_SMTP_HOST"`
+	SmtpPort int    `toml:"smtp_port" env:"MAILER_SMTP_PORT"`
+
+	Workers         int           `toml:"workers" env:"MAILER_WORKERS"`
+	SendTimeout     time.Duration `toml:"send_timeout" env:"MAILER_SEND_TIMEOUT"`
+	MaxAttempts     int           `toml:"max_attempts" env:"MAILER_MAX_ATTEMPTS"`
+	RetryBackoff    time.Duration `toml:"retry_backoff" env:"MAILER_RETRY_BACKOFF"`
+	MaxRetryBackoff time.Duration `toml:"max_retry_backoff" env:"MAILER_MAX_RETRY_BACKOFF"`
+
+	TemplatesDir  string `toml:"templates_dir" env:"MAILER_TEMPLATES_DIR"`
+	DefaultLocale string `toml:"default_locale" env:"MAILER_DEFAULT_LOCALE"`
+}
+
+type NotificationsConfig struct {
+	DigestWindow time.Duration `toml:"digest_window" env:"NOTIFICATIONS_DIGEST_WINDOW"`
+}
+
+// RetentionConfig is the default retention policy, admins can override it with /api/admin/retention.
+type RetentionConfig struct {
+	MaxAge   time.Duration `toml:"max_age" env:"RETENTION_MAX_AGE"`
+	MaxCount int           `toml:"max_count" env:"RETENTION_MAX_COUNT"`
+	Interval time.Duration `toml:"interval" env:"RETENTION_INTERVAL"`
+}
+
+// UnfurlConfig controls the previews of links in messages.
+type UnfurlConfig struct {
+	Enabled bool          `toml:"enabled" env:"UNFURL_ENABLED"`
+	Workers int           `toml:"workers" env:"UNFURL_WORKERS"`
+	Timeout time.Duration `toml:"timeout" env:"UNFURL_TIMEOUT"`
+	// in bytes
+	MaxPageSize int           `toml:"max_page_size" env:"UNFURL_MAX_PAGE_SIZE"`
+	CacheTTL    time.Duration `toml:"cache_ttl" env:"UNFURL_CACHE_TTL"`
+	// for development only, see unfurl.Config
+	AllowPrivateNetworks bool `toml:"allow_private_networks" env:"UNFURL_ALLOW_PRIVATE_NETWORKS"`
+}
+
+type UploadsConfig struct {
+	Dir string `toml:"dir" env:"UPLOADS_DIR"`
+	// in bytes
+	MaxSize       int      `toml:"max_size" env:"UPLOADS_MAX_SIZE"`
+	AllowedTypes  []string `toml:"allowed_types" env:"UPLOADS_ALLOWED_TYPES"`
+	ThumbnailSize int      `toml:"thumbnail_size" env:"UPLOADS_THUMBNAIL_SIZE"`
+}
+
+type SecurityConfig struct {
+	BCryptCost int      `toml:"bcrypt_cost" env:"BCRYPT_COST" flag:"bcrypt-cost" usage:"Cost of bcrypt password hashes"`
+	AdminUsers []string `toml:"admin_users" env:"ADMIN_USERS"`
+	// signs links which work without logging in, e.g. unsubscribe links
+	Secret string `toml:"secret" env:"SECRET" secret:"true"`
+}
+
+type AuditConfig struct {
+	Storage string `toml:"storage" env:"AUDIT_STORAGE"`
+}
+
+type LogConfig struct {
+	Level  string `toml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"Minimal log level: debug, info, warn or error"`
+	Format string `toml:"format" env:"LOG_FORMAT" flag:"log-format" usage:"Log format: text or json"`
+}
+
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Host: "0.0.0.0",
+			Port: 8080,
+		},
+		Websocket: WebsocketConfig{
+			Compression:   true,
+			MaxFrameSize:  4096,
+			MaxTextLength: 2000,
+			ReplaySize:    1000,
+			Backpressure:  "coalesce",
+			MaxLag:        30 * time.Second,
+		},
+		Redis: RedisConfig{
+			Addr: "127.0.0.1:6379",
+		},
+		Mailer: MailerConfig{
+			Transport:       "tls",
+			Dir:             "var/mail",
+			FromName:        "MZNX Chat",
+			TemplatesDir:    "templates/mail",
+			DefaultLocale:   "en",
+			SmtpPort:        465,
+			Workers:         4,
+			SendTimeout:     30 * time.Second,
+			MaxAttempts:     8,
+			RetryBackoff:    30 * time.Second,
+			MaxRetryBackoff: time.Hour,
+		},
+		Notifications: NotificationsConfig{
+			DigestWindow: 15 * time.Minute,
+		},
+		Retention: RetentionConfig{
+			MaxCount: 100000,
+			Interval: 10 * time.Minute,
+		},
+		Unfurl: UnfurlConfig{
+			Enabled:     true,
+			Workers:     4,
+			Timeout:     5 * time.Second,
+			MaxPageSize: 512 << 10,
+			CacheTTL:    24 * time.Hour,
+		},
+		Uploads: UploadsConfig{
+			Dir:     "var/uploads",
+			MaxSize: 10 << 20,
+			AllowedTypes: []string{
+				"image/png", "image/jpeg", "image/gif", "image/webp",
+				"application/pdf", "application/zip", "text/plain",
+			},
+			ThumbnailSize: 320,
+		},
+		Security: SecurityConfig{
+			BCryptCost: 12,
+		},
+		Audit: AuditConfig{
+			Storage: "redis",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// Errors collects every problem found while loading the configuration, so they can be fixed at once.
+type Errors []string
+
+func (errs Errors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(errs, "\n  ")
+}
+
+func (c *Config) Validate() error {
+	var errs Errors
+	check := func(ok bool, format string, arguments ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, arguments...))
+		}
+	}
+
+	check(len(c.Server.Host) > 0, "server.host must not be empty")
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port must be between 1 and 65535, got %d", c.Server.Port)
+	for _, origin := range c.Server.AllowedOrigins {
+		check(strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://"),
+			"server.allowed_origins must be http(s) origins, got %q", origin)
+	}
+	if _, err := security.ParseTrustedProxies(c.Server.TrustedProxies); err != nil {
+		check(false, "server.trusted_proxies: %s", err)
+	}
+
+	check(c.Websocket.MaxFrameSize >= 512, "websocket.max_frame_size must be at least 512, got %d", c.Websocket.MaxFrameSize)
+	check(c.Websocket.MaxTextLength > 0, "websocket.max_text_length must be positive, got %d", c.Websocket.MaxTextLength)
+	check(c.Websocket.ReplaySize > 0, "websocket.replay_size must be positive, got %d", c.Websocket.ReplaySize)
+	switch c.Websocket.Backpressure {
+	case "disconnect", "drop_oldest", "coalesce":
+	default:
+		check(false, "websocket.backpressure must be disconnect, drop_oldest or coalesce, got %q", c.Websocket.Backpressure)
+	}
+	check(c.Websocket.MaxLag > 0, "websocket.max_lag must be positive, got %s", c.Websocket.MaxLag)
+
+	check(len(c.Redis.Addr) > 0, "redis.addr must not be empty")
+	check(c.Redis.DB >= 0, "redis.db must not be negative, got %d", c.Redis.DB)
+
+	switch c.Mailer.Transport {
+	case "tls", "starttls", "plain":
+		check(len(c.Mailer.SmtpHost) > 0, "mailer.smtp_host is required by the %s transport", c.Mailer.Transport)
+		check(c.Mailer.SmtpPort > 0 && c.Mailer.SmtpPort < 65536,
+			"mailer.smtp_port must be between 1 and 65535, got %d", c.Mailer.SmtpPort)
+	case "file":
+		check(len(c.Mailer.Dir) > 0, "mailer.dir is required by the file transport")
+	case "log":
+	default:
+		check(false, "mailer.transport must be tls, starttls, plain, file or log, got %q", c.Mailer.Transport)
+	}
+	check(len(c.Mailer.Sender) > 0, "mailer.sender must not be empty")
+	check(len(c.Mailer.TemplatesDir) > 0, "mailer.templates_dir must not be empty")
+	check(len(c.Mailer.DefaultLocale) > 0, "mailer.default_locale must not be empty")
+	check(c.Mailer.Workers > 0, "mailer.workers must be positive, got %d", c.Mailer.Workers)
+	check(c.Mailer.SendTimeout > 0, "mailer.send_timeout must be positive, got %s", c.Mailer.SendTimeout)
+	check(c.Mailer.MaxAttempts > 0, "mailer.max_attempts must be positive, got %d", c.Mailer.MaxAttempts)
+	check(c.Mailer.RetryBackoff > 0, "mailer.retry_backoff must be positive, got %s", c.Mailer.RetryBackoff)
+	check(c.Mailer.MaxRetryBackoff >= c.Mailer.RetryBackoff,
+		"mailer.max_retry_backoff must not be less than mailer.retry_backoff, got %s", c.Mailer.MaxRetryBackoff)
+
+	check(c.Notifications.DigestWindow > 0,
+		"notifications.digest_window must be positive, got %s", c.Notifications.DigestWindow)
+
+	check(c.Retention.MaxAge >= 0, "retention.max_age must not be negative, got %s", c.Retention.MaxAge)
+	check(c.Retention.MaxCount >= 0, "retention.max_count must not be negative, got %d", c.Retention.MaxCount)
+	check(c.Retention.Interval > 0, "retention.interval must be positive, got %s", c.Retention.Interval)
+
+	if c.Unfurl.Enabled {
+		check(c.Unfurl.Workers > 0, "unfurl.workers must be positive, got %d", c.Unfurl.Workers)
+		check(c.Unfurl.Timeout > 0, "unfurl.timeout must be positive, got %s", c.Unfurl.Timeout)
+		check(c.Unfurl.MaxPageSize > 0, "unfurl.max_page_size must be positive, got %d", c.Unfurl.MaxPageSize)
+		check(c.Unfurl.CacheTTL > 0, "unfurl.cache_ttl must be positive, got %s", c.Unfurl.CacheTTL)
+	}
+
+	check(len(c.Uploads.Dir) > 0, "uploads.dir must not be empty")
+	check(c.Uploads.MaxSize > 0, "uploads.max_size must be positive, got %d", c.Uploads.MaxSize)
+	check(len(c.Uploads.AllowedTypes) > 0, "uploads.allowed_types must not be empty")
+	check(c.Uploads.ThumbnailSize > 0, "uploads.thumbnail_size must be positive, got %d", c.Uploads.ThumbnailSize)
+
+	// bcrypt.MinCost and bcrypt.MaxCost
+	check(c.Security.BCryptCost >= 4 && c.Security.BCryptCost <= 31,
+		"security.bcrypt_cost must be between 4 and 31, got %d", c.Security.BCryptCost)
+	check(len(c.Security.Secret) >= 32, "security.secret must be at least 32 characters long")
+	check(c.Security.Secret != placeholderSecret,
+		"security.secret must be changed from the value in the example configuration")
+
+	check(c.Audit.Storage == "redis" || c.Audit.Storage == "memory",
+		"audit.storage must be redis or memory, got %q", c.Audit.Storage)
+
+	if _, err := logger.ParseLevel(c.Log.Level); err != nil {
+		check(false, "log.level: %s", err)
+	}
+	if _, err := logger.NewEncoder(c.Log.Format); err != nil {
+		check(false, "log.format: %s", err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigFileEnv points to the config file when the -config flag is not given.
+const ConfigFileEnv = "CHAT_CONFIG"
+
+type field struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+// Load builds the configuration in layers: defaults, the TOML config file, environment variables and
+// finally command line flags. The returned Config is filled as far as possible even when an error is
+// returned, so that it can still be printed by `chat config check`.
+func Load(name string, args []string) (Config, error) {
+	c := Default()
+	fields := collectFields(&c)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv(ConfigFileEnv), "Path to the TOML config file")
+	flagValues := make(map[string]*string)
+	for _, f := range fields {
+		if len(f.flag) > 0 {
+			flagValues[f.flag] = flags.String(f.flag, "", fmt.Sprintf("%s (%s)", f.usage, f.key))
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return c, err
+	}
+
+	var errs Errors
+	if len(*configFile) > 0 {
+		values, err := readFile(*configFile)
+		if err != nil {
+			return c, err
+		}
+
+		for _, f := range fields {
+			if value, ok := values[f.key]; ok {
+				if err := setValue(f.value, value); err != nil {
+					errs = append(errs, fmt.Sprintf("%s in %s: %s", f.key, *configFile, err))
+				}
+				delete(values, f.key)
+			}
+		}
+		for key := range values {
+			errs = append(errs, fmt.Sprintf("%s in %s: unknown key", key, *configFile))
+		}
+	}
+
+	for _, f := range fields {
+		raw, ok := os.LookupEnv(f.env)
+		if len(f.env) == 0 || !ok {
+			continue
+		}
+
+		if err := setValue(f.value, envValue(f.value, raw)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s from $%s: %s", f.key, f.env, err))
+		}
+	}
+
+	visited := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		visited[f.Name] = true
+	})
+	for _, f := range fields {
+		if !visited[f.flag] {
+			continue
+		}
+
+		if err := setValue(f.value, envValue(f.value, *flagValues[f.flag])); err != nil {
+			errs = append(errs, fmt.Sprintf("%s from -%s: %s", f.key, f.flag, err))
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err.(Errors)...)
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+
+	return c, nil
+}
+
+func collectFields(c *Config) []field {
+	var fields []field
+	root := reflect.ValueOf(c).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		table := root.Field(i)
+		tableName := root.Type().Field(i).Tag.Get("toml")
+
+		for j := 0; j < table.NumField(); j++ {
+			tag := table.Type().Field(j).Tag
+			fields = append(fields, field{
+				key:    tableName + "." + tag.Get("toml"),
+				env:    tag.Get("env"),
+				flag:   tag.Get("flag"),
+				usage:  tag.Get("usage"),
+				secret: tag.Get("secret") == "true",
+				value:  table.Field(j),
+			})
+		}
+	}
+
+	return fields
+}
+
+// envValue splits comma separated lists, the way ALLOWED_ORIGINS has always been written.
+func envValue(target reflect.Value, raw string) value {
+	if target.Kind() != reflect.Slice {
+		return value{text: raw}
+	}
+
+	list := make([]string, 0)
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+
+	return value{list: list, isList: true}
+}
+
+func setValue(target reflect.Value, v value) error {
+	if target.Kind() == reflect.Slice {
+		if !v.isList {
+			return fmt.Errorf("expected a list, got %q", v.text)
+		}
+		target.Set(reflect.ValueOf(append([]string(nil), v.list...)))
+		return nil
+	}
+	if v.isList {
+		return fmt.Errorf("expected a single value, got a list")
+	}
+
+	switch {
+	case target.Type() == reflect.TypeOf(time.Duration(0)):
+		duration, err := time.ParseDuration(v.text)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v.text)
+		}
+		target.SetInt(int64(duration))
+	case target.Kind() == reflect.Int:
+		number, err := strconv.Atoi(strings.TrimSpace(v.text))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v.text)
+		}
+		target.SetInt(int64(number))
+	case target.Kind() == reflect.Bool:
+		flag, err := strconv.ParseBool(strings.TrimSpace(v.text))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v.text)
+		}
+		target.SetBool(flag)
+	case target.Kind() == reflect.String:
+		target.SetString(v.text)
+	default:
+		return fmt.Errorf("unsupported field type %s", target.Type())
+	}
+
+	return nil
+}
+
+func readFile(path string) (map[string]value, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	values, err := parseTOML(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+
+	return values, nil
+}
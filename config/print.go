@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const mask = "********"
+
+// Print writes the configuration as a TOML document, the secrets are masked.
+func (c Config) Print(w io.Writer) {
+	table := ""
+	for _, f := range collectFields(&c) {
+		parts := strings.SplitN(f.key, ".", 2)
+		if parts[0] != table {
+			if len(table) > 0 {
+				_, _ = fmt.Fprintln(w)
+			}
+			table = parts[0]
+			_, _ = fmt.Fprintf(w, "[%s]\n", table)
+		}
+
+		_, _ = fmt.Fprintf(w, "%s = %s\n", parts[1], formatValue(f))
+	}
+}
+
+func formatValue(f field) string {
+	if f.secret && !f.value.IsZero() {
+		return strconv.Quote(mask)
+	}
+
+	switch {
+	case f.value.Type() == reflect.TypeOf(time.Duration(0)):
+		return strconv.Quote(time.Duration(f.value.Int()).String())
+	case f.value.Kind() == reflect.Slice:
+		items := make([]string, 0, f.value.Len())
+		for i := 0; i < f.value.Len(); i++ {
+			items = append(items, strconv.Quote(f.value.Index(i).String()))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case f.value.Kind() == reflect.String:
+		return strconv.Quote(f.value.String())
+	}
+
+	return fmt.Sprint(f.value.Interface())
+}
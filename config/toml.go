@@ -0,0 +1,210 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TOML integers: decimal, an optional sign and underscores between digits
+var integerPattern = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)$`)
+
+var basicEscapes = map[rune]rune{'b': '\b', 't': '\t', 'n': '\n', 'f': '\f', 'r': '\r', '"': '"', '\\': '\\'}
+
+type value struct {
+	text   string
+	list   []string
+	isList bool
+}
+
+// parseTOML reads the subset of TOML the config needs: [tables], key = value pairs with basic or literal
+// strings, integers, booleans and single-line arrays, and # comments. Keys are returned as "table.key".
+func parseTOML(content string) (map[string]value, error) {
+	values := make(map[string]value)
+	table := ""
+
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", i+1)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		if len(table) > 0 {
+			key = table + "." + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", i+1, key)
+		}
+
+		v, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		values[key] = v
+	}
+
+	return values, nil
+}
+
+func parseValue(raw string) (value, error) {
+	if !strings.HasPrefix(raw, "[") {
+		text, err := parseScalar(raw)
+		return value{text: text}, err
+	}
+
+	if !strings.HasSuffix(raw, "]") {
+		return value{}, fmt.Errorf("unterminated array")
+	}
+
+	list := make([]string, 0)
+	for _, item := range splitArray(raw[1 : len(raw)-1]) {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		text, err := parseScalar(item)
+		if err != nil {
+			return value{}, err
+		}
+		list = append(list, text)
+	}
+
+	return value{list: list, isList: true}, nil
+}
+
+func parseScalar(raw string) (string, error) {
+	switch {
+	case len(raw) == 0:
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, `"`):
+		text, ok := unquoteBasic(raw)
+		if !ok {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return text, nil
+	case strings.HasPrefix(raw, "'"):
+		// literal strings have no escapes, so they cannot contain a single quote
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	case integerPattern.MatchString(raw):
+		// converted by setValue, like the other values
+		return strings.ReplaceAll(raw, "_", ""), nil
+	}
+
+	return "", fmt.Errorf("invalid value %s, strings must be quoted", raw)
+}
+
+// unquoteBasic decodes a TOML basic string, with its escapes: \b \t \n \f \r \" \\ \uXXXX and \UXXXXXXXX.
+func unquoteBasic(raw string) (string, bool) {
+	if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+		return "", false
+	}
+
+	var text strings.Builder
+	inner := raw[1 : len(raw)-1]
+	for i := 0; i < len(inner); {
+		r, size := utf8.DecodeRuneInString(inner[i:])
+		switch {
+		case r == '"' || r == utf8.RuneError && size == 1:
+			return "", false
+		case r != '\\':
+			text.WriteRune(r)
+			i += size
+			continue
+		}
+
+		if i+1 == len(inner) {
+			return "", false
+		}
+		escape := rune(inner[i+1])
+		if decoded, ok := basicEscapes[escape]; ok {
+			text.WriteRune(decoded)
+			i += 2
+			continue
+		}
+
+		digits := map[rune]int{'u': 4, 'U': 8}[escape]
+		if digits == 0 || i+2+digits > len(inner) {
+			return "", false
+		}
+		code, err := strconv.ParseUint(inner[i+2:i+2+digits], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return "", false
+		}
+		text.WriteRune(rune(code))
+		i += 2 + digits
+	}
+
+	return text.String(), true
+}
+
+// splitArray splits array items on commas which are not inside quotes.
+func splitArray(raw string) []string {
+	var items []string
+	start := 0
+	scanQuoted(raw, func(i int, r rune) bool {
+		if r == ',' {
+			items = append(items, raw[start:i])
+			start = i + 1
+		}
+		return true
+	})
+
+	return append(items, raw[start:])
+}
+
+func stripComment(line string) string {
+	end := len(line)
+	scanQuoted(line, func(i int, r rune) bool {
+		if r == '#' {
+			end = i
+			return false
+		}
+		return true
+	})
+
+	return line[:end]
+}
+
+// scanQuoted calls visit with the runes which are outside quoted strings, until visit returns false. Like
+// splitArgs in the websocket package it tracks escapes with a toggle, so "C:\\" ends the string; literal
+// strings in single quotes have no escapes.
+func scanQuoted(raw string, visit func(i int, r rune) bool) {
+	var quote rune
+	escaped := false
+	for i, r := range raw {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+		case r == '"' || r == '\'':
+			quote = r
+		case !visit(i, r):
+			return
+		}
+	}
+}
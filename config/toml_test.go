@@ -0,0 +1,79 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		values  map[string]value
+	}{
+		{"integer", "port = 8080", map[string]value{"port": {text: "8080"}}},
+		{"integer with underscores", "max = 10_000", map[string]value{"max": {text: "10000"}}},
+		{"negative integer", "n = -1", map[string]value{"n": {text: "-1"}}},
+		{"boolean", "enabled = true", map[string]value{"enabled": {text: "true"}}},
+		{"basic string", `name = "chat"`, map[string]value{"name": {text: "chat"}}},
+		{"literal string", `dir = 'C:\data\'`, map[string]value{"dir": {text: `C:\data\`}}},
+		{"escapes", `s = "a\tb\n\"c\" \\ \u00e9 \U0001F600"`, map[string]value{"s": {text: "a\tb\n\"c\" \\ é 😀"}}},
+		{"escaped backslash before comment", `dir = "C:\\data\\" # note`, map[string]value{"dir": {text: `C:\data\`}}},
+		{"escaped quote before comment", `s = "say \"#hi\"" # note`, map[string]value{"s": {text: `say "#hi"`}}},
+		{"hash in literal string", `s = 'a#b' # note`, map[string]value{"s": {text: "a#b"}}},
+		{"comment", "# comment\nport = 1 # note", map[string]value{"port": {text: "1"}}},
+		{"table", "[redis]\naddr = \"localhost:6379\"", map[string]value{"redis.addr": {text: "localhost:6379"}}},
+		{"empty array", "list = []", map[string]value{"list": {list: []string{}, isList: true}}},
+		{
+			"array",
+			`list = ["a,b", 'c', "d\\", "e"] # note`,
+			map[string]value{"list": {list: []string{"a,b", "c", `d\`, "e"}, isList: true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := parseTOML(test.content)
+			if err != nil {
+				t.Fatalf("parseTOML(%q): %s", test.content, err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("parseTOML(%q)\n got %+v\nwant %+v", test.content, values, test.values)
+			}
+		})
+	}
+}
+
+func TestParseTOMLInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"bare word", "name = chat"},
+		{"bare duration", "timeout = 5s"},
+		{"missing value", "name ="},
+		{"missing key", "= 1"},
+		{"duplicate key", "a = 1\na = 2"},
+		{"unterminated table", "[redis"},
+		{"unterminated string", `name = "chat`},
+		{"unterminated string before comment", `dir = "C:\" # note`},
+		{"unterminated array", `list = ["a"`},
+		{"unknown escape", `s = "\d"`},
+		{"Go escape", `s = "\x41"`},
+		{"short unicode escape", `s = "\u00"`},
+		{"surrogate", `s = "\uD800"`},
+		{"quote inside string", `s = "a"b"`},
+		{"quote inside literal string", `s = 'a'b'`},
+		{"leading zero", "n = 01"},
+		{"trailing underscore", "n = 1_"},
+		{"bare word in array", "list = [a]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if values, err := parseTOML(test.content); err == nil {
+				t.Errorf("parseTOML(%q) gives %+v, want an error", test.content, values)
+			}
+		})
+	}
+}
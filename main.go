@@ -1,65 +1,239 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/mazanax/go-chat/app"
 	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/mailer"
 	"github.com/mazanax/go-chat/app/models"
+	"github.com/mazanax/go-chat/app/security"
+	"github.com/mazanax/go-chat/app/unfurl"
 	"github.com/mazanax/go-chat/config"
 	"github.com/mazanax/go-chat/websocket"
 	"github.com/rs/cors"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
+const shutdownTimeout = 15 * time.Second
+
 func main() {
-	logger.Debug("[Go Chat v0.0.1]\n")
-	host := flag.String("host", "<none>", "Host to listen to")
-	port := flag.Int("port", -1, "Port to listen to")
-	flag.Parse()
-
-	if *host == "<none>" || *port <= 0 {
-		logger.Debug("Usage:\n")
-		logger.Debug("    chat -host=<HOST> -port=<PORT>\n")
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		os.Exit(configCheck(os.Args[3:]))
+	}
+
+	cfg, err := config.Load("chat", os.Args[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	case err != nil:
+		_, _ = fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	logger.Debug("Starting listen to %s:%d...\n", *host, *port)
+
+	configureLogger(cfg.Log)
+	logger.Info("[Go Chat v0.0.1]\n")
+	logger.Info("Starting listen to %s:%d...\n", cfg.Server.Host, cfg.Server.Port)
 
 	notifications := make(chan *models.Message)
+	// validated with the rest of the configuration
+	trustedProxies, _ := security.ParseTrustedProxies(cfg.Server.TrustedProxies)
 
 	config_ := app.Config{
-		RedisAddr:      config.RedisAddr,
-		RedisPassword:  config.RedisPassword,
-		RedisDB:        config.RedisDB,
-		MailerLogin:    config.MailerLogin,
-		MailerSender:   config.MailerSender,
-		MailerPassword: config.MailerPassword,
-		MailerSmtpHost: config.MailerSmtpHost,
-		MailerSmtpPort: config.MailerSmtpPort,
-		BCryptCost:     config.BCryptCost,
+		PublicHost:     cfg.Server.PublicHost,
+		TrustedProxies: trustedProxies,
+		RedisAddr:      cfg.Redis.Addr,
+		RedisPassword:  cfg.Redis.Password,
+		RedisDB:        cfg.Redis.DB,
+		Mailer: mailer.Config{
+			Sender:   cfg.Mailer.Sender,
+			FromName: cfg.Mailer.FromName,
+			Transport: mailer.TransportConfig{
+				Kind:          cfg.Mailer.Transport,
+				Login:         cfg.Mailer.Login,
+				Password:      cfg.Mailer.Password,
+				SmtpHost:      cfg.Mailer.SmtpHost,
+				SmtpPort:      cfg.Mailer.SmtpPort,
+				TLSSkipVerify: cfg.Mailer.TLSSkipVerify,
+				Dir:           cfg.Mailer.Dir,
+			},
+			Workers:         cfg.Mailer.Workers,
+			SendTimeout:     cfg.Mailer.SendTimeout,
+			MaxAttempts:     cfg.Mailer.MaxAttempts,
+			RetryBackoff:    cfg.Mailer.RetryBackoff,
+			MaxRetryBackoff: cfg.Mailer.MaxRetryBackoff,
+		},
+		MailTemplatesDir:  cfg.Mailer.TemplatesDir,
+		MailDefaultLocale: cfg.Mailer.DefaultLocale,
+		DigestWindow:      cfg.Notifications.DigestWindow,
+		Secret:            cfg.Security.Secret,
+		Retention: models.RetentionPolicy{
+			MaxAge:   cfg.Retention.MaxAge,
+			MaxCount: cfg.Retention.MaxCount,
+		},
+		RetentionInterval:  cfg.Retention.Interval,
+		UploadsDir:         cfg.Uploads.Dir,
+		UploadMaxSize:      cfg.Uploads.MaxSize,
+		UploadAllowedTypes: cfg.Uploads.AllowedTypes,
+		ThumbnailSize:      cfg.Uploads.ThumbnailSize,
+		BCryptCost:         cfg.Security.BCryptCost,
+		AdminUsers:         cfg.Security.AdminUsers,
+		AuditStorage:       cfg.Audit.Storage,
+		UnfurlEnabled:      cfg.Unfurl.Enabled,
+		Unfurl: unfurl.Config{
+			Workers:              cfg.Unfurl.Workers,
+			Timeout:              cfg.Unfurl.Timeout,
+			MaxPageSize:          int64(cfg.Unfurl.MaxPageSize),
+			CacheTTL:             cfg.Unfurl.CacheTTL,
+			AllowPrivateNetworks: cfg.Unfurl.AllowPrivateNetworks,
+		},
 	}
 	app_ := app.New(config_, notifications)
-	go app_.Mailer.Run()
 
-	hub := websocket.NewHub(app_.TicketRepository, app_.OnlineRepository, app_.MessageRepository, notifications)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	var workers sync.WaitGroup
+	workers.Add(3)
+	go func() {
+		defer workers.Done()
+		app_.Mailer.Run(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		app_.Notifier.Run(ctx)
+	}()
+	go func() {
+		defer workers.Done()
+		app_.Janitor.Run(ctx)
+	}()
+	notifiers := websocket.Notifiers{app_.Notifier}
+	if app_.Unfurler != nil {
+		notifiers = append(notifiers, app_.Unfurler)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			app_.Unfurler.Run(ctx)
+		}()
+	}
+
+	hubConfig := websocket.Config{
+		AllowedOrigins: cfg.Server.AllowedOrigins,
+		TrustedProxies: trustedProxies,
+		Compression:    cfg.Websocket.Compression,
+		MaxFrameSize:   cfg.Websocket.MaxFrameSize,
+		MaxTextLength:  cfg.Websocket.MaxTextLength,
+		ReplaySize:     cfg.Websocket.ReplaySize,
+		Backpressure:   cfg.Websocket.Backpressure,
+		MaxLag:         cfg.Websocket.MaxLag,
+	}
+	hub := websocket.NewHub(
+		hubConfig,
+		app_.TicketRepository,
+		app_.AccessTokenRepository,
+		app_.UserRepository,
+		app_.OnlineRepository,
+		app_.MessageRepository,
+		app_.UploadRepository,
+		app_.EventRepository,
+		notifiers,
+		notifications,
+	)
+	for _, command := range app_.Commands() {
+		hub.RegisterCommand(command)
+	}
 	go hub.Run()
+	app_.AddReadinessCheck("hub", hub.Ping)
 	app_.Router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("[http] Incoming Websocket connection\n")
+		logger.FromContext(r.Context()).Debug("[http] Incoming Websocket connection\n")
 		websocket.ServeWs(hub, w, r)
 	})
+	// fallbacks for clients behind proxies which break websockets
+	app_.Router.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		websocket.ServeEvents(hub, w, r)
+	}).Methods("GET")
+	app_.Router.HandleFunc("/api/events/poll", func(w http.ResponseWriter, r *http.Request) {
+		websocket.ServePoll(hub, w, r)
+	}).Methods("GET")
+	app_.Router.HandleFunc("/api/messages", func(w http.ResponseWriter, r *http.Request) {
+		websocket.ServeMessages(hub, w, r)
+	}).Methods("POST")
 	http.HandleFunc("/", app_.Router.ServeHTTP)
 
 	c := cors.New(cors.Options{
-		AllowedOrigins:   config.AllowedOrigins,
+		AllowedOrigins:   cfg.Server.AllowedOrigins,
 		AllowedHeaders:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PATCH"},
+		AllowedMethods:   []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
 		AllowCredentials: true,
 	})
 
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", *host, *port), c.Handler(app_.Router))
-	if err != nil {
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
+		Handler: c.Handler(app_.Router),
+	}
+	go shutdownOnSignal(server, stop)
+
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Error("ListenAndServe: %s\n", err.Error())
 		os.Exit(2)
 	}
+
+	// let the mailer finish the mails it is sending
+	workers.Wait()
+}
+
+// shutdownOnSignal stops accepting requests on SIGINT or SIGTERM and cancels the background workers.
+func shutdownOnSignal(server *http.Server, stop context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logger.Info("Got %s, shutting down...\n", sig)
+
+	stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("Shutdown: %s\n", err)
+	}
+}
+
+// configCheck implements `chat config check [flags]`: it prints the effective configuration with the secrets
+// masked and reports every validation error.
+func configCheck(args []string) int {
+	cfg, err := config.Load("chat config check", args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+
+	var validationErrors config.Errors
+	if err != nil && !errors.As(err, &validationErrors) {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	cfg.Print(os.Stdout)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "\n%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func configureLogger(cfg config.LogConfig) {
+	// both values are checked by config.Validate
+	level, _ := logger.ParseLevel(cfg.Level)
+	encoder, _ := logger.NewEncoder(cfg.Format)
+
+	logger.SetLevel(level)
+	logger.SetEncoder(encoder)
 }
@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"github.com/google/uuid"
+	"github.com/mazanax/go-chat/app/models"
+	"sync/atomic"
+	"time"
+)
+
+// Backpressure policies, they decide what happens to a client whose send buffer is full.
+const (
+	// the client is disconnected right away
+	BackpressureDisconnect = "disconnect"
+	// the oldest queued events are dropped to make room for the new one
+	BackpressureDropOldest = "drop_oldest"
+	// queued presence events of a user are merged into the latest one, then the oldest events are dropped
+	BackpressureCoalesce = "coalesce"
+)
+
+// send queues the message for the client. It never blocks, so one slow client cannot hold up the hub. A client
+// which does not keep up loses events as the backpressure policy says and is told how many it lost, a client
+// which keeps lagging for longer than maxLag is disconnected.
+func (h *Hub) send(client *Client, message *models.Message) {
+	if len(client.send) <= cap(client.send)/2 {
+		client.laggingSince = time.Time{}
+	}
+
+	select {
+	case client.send <- message:
+		return
+	default:
+	}
+
+	now := time.Now()
+	if client.laggingSince.IsZero() {
+		client.laggingSince = now
+	}
+	if h.backpressure == BackpressureDisconnect || now.Sub(client.laggingSince) > h.maxLag {
+		droppedClients.Inc()
+		h.remove(client)
+		return
+	}
+
+	if h.backpressure == BackpressureCoalesce {
+		h.coalesce(client)
+	}
+	for {
+		select {
+		case client.send <- message:
+			return
+		default:
+		}
+
+		select {
+		case <-client.send:
+			atomic.AddInt64(&client.dropped, 1)
+			droppedEvents.WithLabelValues("dropped").Inc()
+		default:
+		}
+	}
+}
+
+// coalesce drains the buffer of the client and queues the events again without the presence events which are
+// followed by a later one of the same user. The writer may take events meanwhile, which keeps them in order,
+// and nothing blocks as only the hub sends to the buffer.
+func (h *Hub) coalesce(client *Client) {
+	queued := make([]*models.Message, 0, len(client.send))
+	for drained := false; !drained; {
+		select {
+		case message := <-client.send:
+			queued = append(queued, message)
+		default:
+			drained = true
+		}
+	}
+
+	latest := make(map[string]int)
+	for i, message := range queued {
+		if isPresence(message) {
+			latest[message.UserID] = i
+		}
+	}
+	for i, message := range queued {
+		if isPresence(message) && latest[message.UserID] != i {
+			droppedEvents.WithLabelValues("coalesced").Inc()
+			continue
+		}
+		client.send <- message
+	}
+}
+
+func isPresence(message *models.Message) bool {
+	return message.Type == models.UserConnected || message.Type == models.UserDisconnected
+}
+
+// droppedNotice returns an EventsDropped notification if events were dropped since the last call, writers
+// send it before the next events.
+func (c *Client) droppedNotice() *models.Message {
+	dropped := atomic.SwapInt64(&c.dropped, 0)
+	if dropped == 0 {
+		return nil
+	}
+
+	return &models.Message{
+		ID:        uuid.NewString(),
+		UserID:    c.userID,
+		Type:      models.EventsDropped,
+		CreatedAt: int(time.Now().Unix()),
+		Data:      map[string]int64{"dropped": dropped},
+	}
+}
+
+// batch returns the message together with the ones queued after it, preceded by the dropped notice if any.
+func (c *Client) batch(message *models.Message) []*models.Message {
+	n := len(c.send)
+	batch := make([]*models.Message, 0, n+2)
+	if notice := c.droppedNotice(); notice != nil {
+		batch = append(batch, notice)
+	}
+	batch = append(batch, message)
+
+	for i := 0; i < n; i++ {
+		select {
+		case queued, ok := <-c.send:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, queued)
+		default:
+			// taken away by Hub.coalesce
+			return batch
+		}
+	}
+
+	return batch
+}
@@ -4,13 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
-	"github.com/google/uuid"
+	"fmt"
 	"github.com/mazanax/go-chat/app/db"
 	"github.com/mazanax/go-chat/app/logger"
 	"github.com/mazanax/go-chat/app/models"
-	"github.com/mazanax/go-chat/config"
+	"github.com/mazanax/go-chat/app/msgpack"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,7 +22,13 @@ const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	maxAttachments = 10
+	sendBufferSize = 256
+	// frames up to this many times the frame size limit are discarded with an error, larger ones close the
+	// connection
+	oversizeFactor = 4
+	// frames smaller than this are sent uncompressed
+	compressionThreshold = 128
 )
 
 var (
@@ -28,73 +36,152 @@ var (
 	space   = []byte{' '}
 )
 
-var (
-	upgraderInitialized bool = false
-	upgrader            websocket.Upgrader
-)
+var frameTooLarge = errors.New("frame is too large")
 
 type Client struct {
+	// number of events dropped by Hub.send since the last notice, first for 64-bit alignment of atomic access
+	dropped int64
 	// UUID of user
 	userID string
 	hub    *Hub
 	conn   *websocket.Conn
-	send   chan *models.Message
+	// address of the user, as told by the trusted proxies
+	ip string
+	// protocolLegacy or protocolV1, negotiated by ServeWs
+	protocol int
+	// encodingJSON or encodingMessagePack, the latter for protocol v1 only
+	encoding int
+	send     chan *models.Message
+	// whether the client asked for the events after resumeFrom, see Hub.replay
+	resume     bool
+	resumeFrom int64
+	// long polls come and go with every request, they do not count as connections of the user
+	transient bool
+	// when the send buffer was found full, zero if the client keeps up; used by the hub only
+	laggingSince time.Time
+	// acks and errors for this client only
+	replies chan outboundFrame
+	// closed when writePump returns, nobody reads replies after that
+	done chan struct{}
 }
 
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
-		c.hub.notifications <- &models.Message{
-			ID:        uuid.NewString(),
-			UserID:    c.userID,
-			CreatedAt: int(time.Now().Unix()),
-			Type:      models.UserDisconnected,
-		}
 
 		if err := c.conn.Close(); err != nil {
 			logger.Error(err.Error())
 		}
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(int64(c.hub.maxFrameSize) * oversizeFactor)
 	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
 	for {
-		_, message, err := c.conn.ReadMessage()
+		messageType, message, err := c.read()
+		if errors.Is(err, frameTooLarge) {
+			logger.With("user_id", c.userID).Debug("[websocket] Frame rejected: %s\n", err)
+			if c.protocol == protocolV1 {
+				message := fmt.Sprintf("frames are limited to %d bytes", c.hub.maxFrameSize)
+				c.reply(errorFrame("", &protocolError{ErrorFrameTooLarge, message}))
+			}
+			continue
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				logger.Fatal("[websocket] Error: %v", err)
+				logger.With("user_id", c.userID).Warn("[websocket] Unexpected close: %v\n", err)
 			}
 			break
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		logger.Debug("[websocket] Got new message from %s: %s\n", c.conn.RemoteAddr().String(), string(message))
+		if c.encoding == encodingMessagePack {
+			if messageType != websocket.BinaryMessage {
+				c.reply(errorFrame("", &protocolError{ErrorBadFrame, "frames must be binary MessagePack"}))
+				continue
+			}
+			if message, err = msgpack.ToJSON(message); err != nil {
+				c.reply(errorFrame("", &protocolError{ErrorBadFrame, err.Error()}))
+				continue
+			}
+		} else {
+			message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		}
+		logger.With("user_id", c.userID, "remote_addr", c.conn.RemoteAddr().String(), "size", len(message)).
+			Debug("[websocket] Got new message\n")
+
+		if c.protocol == protocolV1 {
+			c.handleFrame(message)
+			continue
+		}
 
 		msg := models.WebsocketMessage{}
 		if err := json.Unmarshal(message, &msg); err != nil {
 			logger.Error("[websocket] Cannot decode message: %s\n", err)
 			continue
 		}
+		if _, err := c.hub.execute(c, c.userID, msg); err != nil {
+			logger.With("user_id", c.userID).Debug("[websocket] Message rejected: %s\n", err)
+		}
+	}
+}
 
-		clearText := strings.ReplaceAll(strings.ReplaceAll(msg.Text, "\n", ""), " ", "")
-		if len(msg.Text) == 0 || len(clearText) == 0 {
-			continue
+// read returns the next message, or frameTooLarge if it exceeds the frame size limit once inflated. The rest
+// of such a message is skipped by the next call, the read limit of the connection bounds how much that is.
+func (c *Client) read() (int, []byte, error) {
+	messageType, reader, err := c.conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(reader, int64(c.hub.maxFrameSize)+1))
+	if err != nil {
+		return messageType, nil, err
+	}
+	if len(message) > c.hub.maxFrameSize {
+		return messageType, nil, frameTooLarge
+	}
+
+	return messageType, message, nil
+}
+
+// handleFrame answers every frame of protocol v1 with an ack or an error.
+func (c *Client) handleFrame(message []byte) {
+	var frame inboundFrame
+	if err := json.Unmarshal(message, &frame); err != nil {
+		c.reply(errorFrame("", &protocolError{ErrorBadFrame, "frame is not a JSON object"}))
+		return
+	}
+
+	switch frame.Op {
+	case OpSend:
+		var msg models.WebsocketMessage
+		if err := json.Unmarshal(frame.Data, &msg); err != nil {
+			c.reply(errorFrame(frame.Ref, &protocolError{ErrorBadFrame, "data of send must be a message"}))
+			return
 		}
 
-		messageID, err := c.hub.messageRepository.StoreMessage(c.userID, models.RegularMessage, msg.ID, msg.Text)
+		stored, err := c.hub.execute(c, c.userID, msg)
 		if err != nil {
-			logger.Error("[websocket] Cannot save message from %s: %s\n", c.userID, err)
-			continue
+			c.reply(errorFrame(frame.Ref, err))
+			return
 		}
-		messageModel, err := c.hub.messageRepository.GetMessage(messageID)
-		if err != nil {
-			logger.Error("[websocket] Cannot get message #%s from %s: %s\n", messageID, c.userID, err)
-			continue
+		// a command which stores nothing, like /help, is acked without data
+		var data interface{}
+		if stored != nil {
+			data = mapMessageToJson(*stored)
 		}
+		c.reply(outboundFrame{Op: OpAck, Ref: frame.Ref, Data: data})
+	default:
+		c.reply(errorFrame(frame.Ref, &protocolError{ErrorUnknownOp, "unknown op " + strconv.Quote(frame.Op)}))
+	}
+}
 
-		c.hub.broadcast <- &messageModel
+// reply queues a frame for this client only.
+func (c *Client) reply(frame outboundFrame) {
+	select {
+	case c.replies <- frame:
+	case <-c.done:
 	}
 }
 
@@ -102,15 +189,9 @@ func (c *Client) writePump() {
 	logger.Debug("[websocket] New client: %s\n", c.conn.RemoteAddr().String())
 	ticker := time.NewTicker(pingPeriod)
 
-	c.hub.notifications <- &models.Message{
-		ID:        uuid.NewString(),
-		UserID:    c.userID,
-		CreatedAt: int(time.Now().Unix()),
-		Type:      models.UserConnected,
-	}
-
 	defer func() {
 		ticker.Stop()
+		close(c.done)
 
 		if err := c.conn.Close(); err != nil {
 			logger.Debug("[websocket] User %s closed connection: %s\n", c.conn.RemoteAddr().String(), err.Error())
@@ -126,26 +207,12 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			if err := c.writeMessages(message); err != nil {
 				return
 			}
-			message_ := encodeMessage(message)
-			if len(message_) > 0 {
-				_, _ = w.Write(encodeMessage(message))
-			}
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				message_ := encodeMessage(<-c.send)
-				if len(message_) > 0 {
-					_, _ = w.Write(newline)
-					_, _ = w.Write(encodeMessage(message))
-				}
-			}
-
-			if err := w.Close(); err != nil {
+		case frame := <-c.replies:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.writeFrame(frame); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -157,26 +224,62 @@ func (c *Client) writePump() {
 	}
 }
 
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	if !upgraderInitialized {
-		upgrader = websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				for _, origin := range config.AllowedOrigins {
-					if origin == r.Header.Get("origin") {
-						return true
-					}
-				}
-
-				return false
-			},
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
+// writeMessages sends the message and the ones queued after it. Protocol v1 sends every event in its own
+// frame, the legacy protocol joins them with newlines.
+func (c *Client) writeMessages(message *models.Message) error {
+	batch := c.batch(message)
+	if c.protocol == protocolV1 {
+		for _, message := range batch {
+			if err := c.writeFrame(outboundFrame{Op: OpEvent, Data: mapMessageToJson(*message)}); err != nil {
+				return err
+			}
 		}
-		upgraderInitialized = true
+
+		return nil
+	}
+
+	c.conn.EnableWriteCompression(true)
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for i, message := range batch {
+		message_ := encodeMessage(message)
+		if len(message_) == 0 {
+			continue
+		}
+		if i > 0 {
+			_, _ = w.Write(newline)
+		}
+		_, _ = w.Write(message_)
+	}
+
+	return w.Close()
+}
+
+func (c *Client) writeFrame(frame outboundFrame) error {
+	messageType := websocket.TextMessage
+	var encoded []byte
+	var err error
+	if c.encoding == encodingMessagePack {
+		messageType = websocket.BinaryMessage
+		encoded, err = msgpack.Marshal(frame)
+	} else {
+		encoded, err = json.Marshal(frame)
 	}
+	if err != nil {
+		logger.Error("[websocket] Cannot encode %s frame: %s\n", frame.Op, err)
+		return nil
+	}
+
+	// deflate does not pay off for small frames, it costs CPU and may even grow them
+	c.conn.EnableWriteCompression(len(encoded) >= compressionThreshold)
+	return c.conn.WriteMessage(messageType, encoded)
+}
 
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	logger.Debug("[websocket] Incoming connection\n")
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := hub.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -195,12 +298,26 @@ func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	protocol, encoding := protocolLegacy, encodingJSON
+	switch conn.Subprotocol() {
+	case SubprotocolV1:
+		protocol = protocolV1
+	case SubprotocolV1MessagePack:
+		protocol, encoding = protocolV1, encodingMessagePack
+	}
+
 	client := &Client{
-		userID: ticket.UserID,
-		hub:    hub,
-		conn:   conn,
-		send:   make(chan *models.Message, 256),
+		userID:   ticket.UserID,
+		ip:       hub.trustedProxies.ClientIP(r),
+		hub:      hub,
+		conn:     conn,
+		protocol: protocol,
+		encoding: encoding,
+		send:     make(chan *models.Message, sendBufferSize),
+		replies:  make(chan outboundFrame, 16),
+		done:     make(chan struct{}),
 	}
+	client.resumeAfter(r.URL.Query().Get("resume_from"))
 	client.hub.register <- client
 
 	err = hub.ticketRepository.RemoveTicket(ticket)
@@ -215,6 +332,24 @@ func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	go client.readPump()
 }
 
+// resumeAfter makes the hub replay the events after the position, unless it is empty.
+func (c *Client) resumeAfter(position string) {
+	if len(position) == 0 {
+		return
+	}
+
+	var err error
+	c.resume = true
+	c.resumeFrom, err = strconv.ParseInt(position, 10, 64)
+	if err != nil || c.resumeFrom < 0 {
+		// nothing can be replayed from an invalid position, the client gets ResyncRequired
+		logger.Warn("[websocket] Invalid resume position %q\n", position)
+		c.resumeFrom = -1
+	}
+	// the whole replay must fit, otherwise the hub drops the client as too slow
+	c.send = make(chan *models.Message, sendBufferSize+c.hub.replaySize)
+}
+
 func encodeMessage(message *models.Message) []byte {
 	jsonMessage, err := json.Marshal(mapMessageToJson(*message))
 	if err != nil {
@@ -227,11 +362,17 @@ func encodeMessage(message *models.Message) []byte {
 
 func mapMessageToJson(message models.Message) models.JsonMessage {
 	return models.JsonMessage{
-		ID:        message.ID,
-		UserID:    message.UserID,
-		Type:      message.Type,
-		CreatedAt: message.CreatedAt,
-		Text:      message.Text,
-		Data:      message.Data,
+		ID:          message.ID,
+		UserID:      message.UserID,
+		Type:        message.Type,
+		CreatedAt:   message.CreatedAt,
+		Text:        message.Text,
+		HTML:        message.HTML,
+		AST:         models.MapMarkupToJson(message.Markup),
+		Mentions:    message.Mentions,
+		Attachments: models.MapUploadsToJson(message.Attachments),
+		Previews:    models.MapPreviewsToJson(message.Previews),
+		Data:        message.Data,
+		Seq:         message.Seq,
 	}
 }
@@ -0,0 +1,327 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/mazanax/go-chat/app/db"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/markdown"
+	"github.com/mazanax/go-chat/app/models"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	shrug = `¯\_(ツ)_/¯`
+	// how long a direct message ID is kept, a retry within this period is not delivered again
+	directMessageTTL = 24 * time.Hour
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// Command is a slash command. Commands are registered with Hub.RegisterCommand before the hub runs, and run
+// in the goroutine reading the caller's connection, so they may block on repositories.
+type Command struct {
+	// without the slash, lowercase
+	Name string
+	// arguments as shown by /help, e.g. "<text>"
+	Usage       string
+	Description string
+	// bounds of the number of arguments, a negative MaxArgs means no limit
+	MinArgs int
+	MaxArgs int
+	// who may run the command and see it in /help, everybody if nil
+	Permission func(user models.User) bool
+	Run        func(call *CommandCall) error
+}
+
+// CommandCall is a single run of a command.
+type CommandCall struct {
+	User models.User
+	// the text after the command name, and the same split into arguments; double quotes group words
+	Input string
+	Args  []string
+	// ID of the message the command was sent as, used by Send
+	MessageID string
+	// address the caller is connected from
+	IP string
+
+	hub    *Hub
+	client *Client
+	stored *models.Message
+}
+
+// CommandFailed is returned by commands to tell the caller what went wrong.
+func CommandFailed(format string, args ...interface{}) error {
+	return &protocolError{ErrorCommandFailed, fmt.Sprintf(format, args...)}
+}
+
+// Reply sends a CommandReply to the caller's connection only. It is not stored and not replayed.
+func (call *CommandCall) Reply(format string, args ...interface{}) {
+	reply := &models.Message{
+		ID:        uuid.NewString(),
+		UserID:    call.User.ID,
+		Type:      models.CommandReply,
+		Text:      fmt.Sprintf(format, args...),
+		CreatedAt: int(time.Now().Unix()),
+	}
+	reply.Render()
+	call.hub.commandReplies <- commandReply{call.client, reply}
+}
+
+// Send stores the text as a message of the caller, like a message sent without a command. The stored message
+// is what the caller's send is acknowledged with.
+func (call *CommandCall) Send(messageType int, text string) error {
+	stored, err := call.hub.submit(call.User.ID, messageType, models.WebsocketMessage{ID: call.MessageID, Text: text})
+	if err != nil {
+		return err
+	}
+	call.stored = &stored
+
+	return nil
+}
+
+type commandReply struct {
+	client  *Client
+	message *models.Message
+}
+
+type directMessage struct {
+	message     *models.Message
+	recipientID string
+}
+
+// RegisterCommand adds a command, or replaces a built-in one. It panics if the name is invalid, like the
+// router does for invalid routes, since commands are registered at startup.
+func (h *Hub) RegisterCommand(command Command) {
+	if !commandNamePattern.MatchString(command.Name) {
+		panic(fmt.Sprintf("invalid command name %q", command.Name))
+	}
+	if command.Run == nil {
+		panic(fmt.Sprintf("command /%s has no Run", command.Name))
+	}
+
+	h.commands[command.Name] = command
+}
+
+// execute runs the command in the text of the message, or stores the message if it is not a command. A text
+// starting with two slashes is a message starting with one. Without a client, as for messages sent over
+// HTTP, commands are not available. The returned message is nil if the command sent nothing.
+func (h *Hub) execute(client *Client, userID string, msg models.WebsocketMessage) (*models.Message, *protocolError) {
+	if !strings.HasPrefix(msg.Text, "/") || strings.HasPrefix(msg.Text, "//") {
+		msg.Text = strings.TrimPrefix(msg.Text, "/")
+		stored, err := h.submit(userID, models.RegularMessage, msg)
+		if err != nil {
+			return nil, err
+		}
+		return &stored, nil
+	}
+
+	name, input := msg.Text[1:], ""
+	if end := strings.IndexFunc(name, unicode.IsSpace); end >= 0 {
+		name, input = name[:end], strings.TrimSpace(name[end:])
+	}
+	name = strings.ToLower(name)
+	if client == nil {
+		return nil, &protocolError{ErrorCommandUnavailable, "commands can only be used over the websocket"}
+	}
+
+	command, ok := h.commands[name]
+	if !ok {
+		commandsRun.WithLabelValues("unknown", "unknown_command").Inc()
+		return nil, &protocolError{ErrorUnknownCommand, fmt.Sprintf("unknown command /%s, see /help", name)}
+	}
+
+	user, err := h.userRepository.GetUser(userID)
+	if err != nil {
+		logger.Error("[websocket] Cannot get user %s for /%s: %s\n", userID, name, err)
+		return nil, &protocolError{ErrorInternal, "command failed"}
+	}
+	if command.Permission != nil && !command.Permission(user) {
+		commandsRun.WithLabelValues(name, "forbidden").Inc()
+		return nil, &protocolError{ErrorForbidden, fmt.Sprintf("you may not use /%s", name)}
+	}
+
+	args, ok := splitArgs(input)
+	if !ok || len(args) < command.MinArgs || (command.MaxArgs >= 0 && len(args) > command.MaxArgs) {
+		commandsRun.WithLabelValues(name, "invalid_arguments").Inc()
+		return nil, &protocolError{ErrorInvalidArguments, strings.TrimSpace("usage: /" + name + " " + command.Usage)}
+	}
+
+	call := &CommandCall{
+		User:      user,
+		Input:     input,
+		Args:      args,
+		MessageID: msg.ID,
+		IP:        client.ip,
+		hub:       h,
+		client:    client,
+	}
+	if err := command.Run(call); err != nil {
+		protocolErr, ok := err.(*protocolError)
+		if !ok {
+			logger.With("user_id", userID).Error("[websocket] Command /%s failed: %s\n", name, err)
+			protocolErr = &protocolError{ErrorInternal, "command failed"}
+		}
+		commandsRun.WithLabelValues(name, protocolErr.code).Inc()
+		return nil, protocolErr
+	}
+	commandsRun.WithLabelValues(name, "ok").Inc()
+
+	return call.stored, nil
+}
+
+// splitArgs splits the input at whitespace, double quotes group words and a backslash escapes a quote. It
+// returns false if a quote is not closed.
+func splitArgs(input string) ([]string, bool) {
+	args := make([]string, 0)
+	var arg strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, r := range input {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case unicode.IsSpace(r) && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, false
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, true
+}
+
+// region built-in commands
+
+func (h *Hub) registerBuiltinCommands() {
+	h.RegisterCommand(Command{
+		Name:        "help",
+		Description: "lists the commands",
+		MaxArgs:     0,
+		Run:         h.help,
+	})
+	h.RegisterCommand(Command{
+		Name:        "me",
+		Usage:       "<action>",
+		Description: "says what you are doing, e.g. /me waves",
+		MinArgs:     1,
+		MaxArgs:     -1,
+		Run: func(call *CommandCall) error {
+			return call.Send(models.ActionMessage, call.Input)
+		},
+	})
+	h.RegisterCommand(Command{
+		Name:        "shrug",
+		Usage:       "[text]",
+		Description: "appends a shrug to the text",
+		MaxArgs:     -1,
+		Run: func(call *CommandCall) error {
+			// the input is markdown already, only the shrug is escaped
+			return call.Send(models.RegularMessage, strings.TrimSpace(call.Input+" "+markdown.Escape(shrug)))
+		},
+	})
+	h.RegisterCommand(Command{
+		Name:        "msg",
+		Usage:       "<username> <text>",
+		Description: "sends a message only the user sees, e.g. /msg alice hi",
+		MinArgs:     2,
+		MaxArgs:     -1,
+		Run:         h.msg,
+	})
+}
+
+func (h *Hub) help(call *CommandCall) error {
+	names := make([]string, 0, len(h.commands))
+	for name, command := range h.commands {
+		if command.Permission == nil || command.Permission(call.User) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		command := h.commands[name]
+		lines = append(lines, strings.TrimSpace("/"+name+" "+command.Usage)+" - "+command.Description)
+	}
+	call.Reply("%s", strings.Join(lines, "\n"))
+
+	return nil
+}
+
+// msg delivers a direct message to the recipient and the sender. Direct messages are events only: they are
+// replayed to both of them but not kept in the history, which everybody can read.
+func (h *Hub) msg(call *CommandCall) error {
+	username := strings.TrimPrefix(call.Args[0], "@")
+	recipient, err := h.userRepository.FindUserByUsername(username)
+	if errors.Is(err, db.UserNotFound) {
+		return CommandFailed("unknown user %s", username)
+	}
+	if err != nil {
+		return err
+	}
+	if recipient.ID == call.User.ID {
+		return CommandFailed("you cannot send a message to yourself")
+	}
+
+	messageID, err := uuid.Parse(call.MessageID)
+	if err != nil {
+		return &protocolError{ErrorInvalidID, "id must be a UUID"}
+	}
+	// the text is the input after the username, as typed
+	text, protocolErr := normalizeText(call.Input[strings.IndexFunc(call.Input, unicode.IsSpace):], h.maxTextLength)
+	if protocolErr != nil {
+		return protocolErr
+	}
+
+	message := &models.Message{
+		ID:        messageID.String(),
+		UserID:    call.User.ID,
+		Type:      models.DirectMessage,
+		CreatedAt: int(time.Now().Unix()),
+		Text:      text,
+		Data:      map[string]string{"recipient_id": recipient.ID},
+	}
+	message.Render()
+	kept, err := h.messageRepository.StoreDirectMessage(*message, recipient.ID, directMessageTTL)
+	switch {
+	case errors.Is(err, db.MessageAlreadyStored):
+		// a retry gets the first message, which was already delivered
+		duplicateMessages.Inc()
+		call.stored = &kept
+		return nil
+	case errors.Is(err, db.MessageIDTaken):
+		return &protocolError{ErrorIDConflict, "id belongs to a message of another user"}
+	case err != nil:
+		logger.Error("[websocket] Cannot save direct message from %s: %s\n", call.User.ID, err)
+		return &protocolError{ErrorInternal, "message was not stored"}
+	}
+	h.directMessages <- directMessage{message, recipient.ID}
+	h.notifier.DirectMessageSent(*message, recipient.ID)
+	call.stored = message
+
+	return nil
+}
+
+// endregion
@@ -0,0 +1,256 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mazanax/go-chat/app/db"
+	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The handlers below serve the event stream of the hub over plain HTTP, for clients behind proxies which break
+// websockets: Server-Sent Events at /api/events, long polling at /api/events/poll and POST /api/messages for
+// sending. See docs/websocket-protocol.md.
+
+const (
+	// comments sent on an idle event stream, so that proxies do not close it
+	heartbeatPeriod = 25 * time.Second
+	// a poll without events is answered after this time, below the usual proxy timeout of 30 seconds
+	pollTimeout = 25 * time.Second
+	// clients authenticated with a header reconnect an event stream after this delay, sent in its retry field
+	reconnectDelay = 3 * time.Second
+)
+
+var Unauthorized = fmt.Errorf("unauthorized")
+
+// ServeEvents streams hub events as Server-Sent Events. Browsers resend the id of the last event in the
+// Last-Event-ID header, the resume_from parameter works like the one of ServeWs.
+func ServeEvents(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	log := logger.FromContext(r.Context())
+	log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error("[websocket] Response writer does not support flushing\n")
+		writeJSON(w, models.InternalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := hub.authenticate(r)
+	if err != nil {
+		log.Debug("[http] Unauthorized\n")
+		writeJSON(w, models.Unauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	position := r.URL.Query().Get("resume_from")
+	if lastEventID := r.Header.Get("Last-Event-ID"); len(lastEventID) > 0 {
+		position = lastEventID
+	}
+	client := hub.subscribe(userID, position, false)
+	defer func() {
+		hub.unregister <- client
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disables response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", reconnectDelay.Milliseconds()); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				// the hub dropped the client
+				return
+			}
+			for _, message := range client.batch(message) {
+				if err := writeEvent(w, message); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ServePoll answers with the events after the since parameter as soon as there are any, or with no events
+// after pollTimeout. Without since only the events which happen during the request are returned.
+func ServePoll(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	log := logger.FromContext(r.Context())
+	log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+	userID, err := hub.authenticate(r)
+	if err != nil {
+		log.Debug("[http] Unauthorized\n")
+		writeJSON(w, models.Unauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	client := hub.subscribe(userID, r.URL.Query().Get("since"), true)
+	defer func() {
+		hub.unregister <- client
+	}()
+
+	events := models.JsonEvents{Events: []models.JsonMessage{}}
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+	select {
+	case message, ok := <-client.send:
+		if !ok {
+			break
+		}
+		// events missed by the next poll are replayed to it, as they come after the last one returned
+		for _, message := range client.batch(message) {
+			events.Events = append(events.Events, mapMessageToJson(*message))
+		}
+	case <-timeout.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	writeJSON(w, events, http.StatusOK)
+}
+
+// ServeMessages stores a message sent over HTTP, the body is a WebsocketMessage. Like the send operation of
+// protocol v1, a retry with the same ID returns the stored message.
+func ServeMessages(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	log := logger.FromContext(r.Context())
+	log.Debug("[http] Request URL: %s %s\n", r.Method, r.URL)
+
+	userID, err := hub.authenticate(r)
+	if err != nil {
+		log.Debug("[http] Unauthorized\n")
+		writeJSON(w, models.Unauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	var msg models.WebsocketMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(hub.maxFrameSize))).Decode(&msg); err != nil {
+		log.Warn("[http] Cannot parse post body. err=%v\n", err)
+		writeJSON(w, models.ErrorResponse{Message: "Invalid message", Code: http.StatusBadRequest}, http.StatusBadRequest)
+		return
+	}
+
+	// without a connection to reply to, commands are rejected
+	message, protocolErr := hub.execute(nil, userID, msg)
+	if protocolErr != nil {
+		log.Debug("[http] Message rejected: %s\n", protocolErr)
+		response := errorResponse(protocolErr)
+		writeJSON(w, response, response.Code)
+		return
+	}
+
+	writeJSON(w, mapMessageToJson(*message), http.StatusCreated)
+}
+
+// authenticate returns the user of the ticket parameter or of the bearer token. A ticket can be used once, so
+// an EventSource reconnecting on its own with the same URL is rejected and the client has to get a new ticket;
+// renewing the ticket instead would turn it into a credential which never expires.
+func (h *Hub) authenticate(r *http.Request) (string, error) {
+	if ticketString := r.URL.Query().Get("ticket"); len(ticketString) > 0 {
+		ticket, err := h.ticketRepository.GetTicket(ticketString)
+		switch {
+		case errors.Is(err, db.TicketNotFound):
+			return "", Unauthorized
+		case err != nil:
+			return "", err
+		}
+
+		if err := h.ticketRepository.RemoveTicket(ticket); err != nil {
+			logger.Error("[websocket] Cannot delete ticket %s: %v\n", ticketString, err)
+		}
+
+		return ticket.UserID, nil
+	}
+
+	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(tokenString) == 0 {
+		return "", Unauthorized
+	}
+
+	accessToken, err := h.accessTokenRepository.FindTokenByString(tokenString)
+	if err != nil {
+		return "", Unauthorized
+	}
+
+	return accessToken.UserID, nil
+}
+
+// subscribe registers a client without a websocket connection, the caller reads its send channel and
+// unregisters it when done.
+func (h *Hub) subscribe(userID string, resumeFrom string, transient bool) *Client {
+	client := &Client{
+		userID:    userID,
+		hub:       h,
+		send:      make(chan *models.Message, sendBufferSize),
+		transient: transient,
+	}
+	client.resumeAfter(resumeFrom)
+	h.register <- client
+
+	return client
+}
+
+// writeEvent writes the message as an event of the stream, its sequence number becomes the id of the event.
+func writeEvent(w http.ResponseWriter, message *models.Message) error {
+	encoded := encodeMessage(message)
+	if len(encoded) == 0 {
+		return nil
+	}
+
+	// an event without id keeps the last one, which is what a ResyncRequired event needs
+	if message.Seq > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", message.Seq); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "data: %s\n\n", encoded)
+
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}, status int) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		logger.Error("Cannot format json. err=%v\n", err)
+	}
+}
+
+// errorResponse maps the error codes of protocol v1 to HTTP responses.
+func errorResponse(err *protocolError) models.ErrorResponse {
+	switch err.code {
+	case ErrorInvalidID:
+		return models.ErrorResponse{Message: err.message, Errors: map[string]string{"id": err.message}, Code: http.StatusBadRequest}
+	case ErrorIDConflict:
+		return models.ErrorResponse{Message: err.message, Errors: map[string]string{"id": err.message}, Code: http.StatusConflict}
+	case ErrorEmptyMessage, ErrorTextTooLong, ErrorInvalidText:
+		return models.ErrorResponse{Message: err.message, Errors: map[string]string{"text": err.message}, Code: http.StatusBadRequest}
+	case ErrorCommandUnavailable:
+		return models.ErrorResponse{Message: err.message, Errors: map[string]string{"text": err.message}, Code: http.StatusUnprocessableEntity}
+	case ErrorInvalidAttachment:
+		return models.ErrorResponse{Message: err.message, Errors: map[string]string{"attachments": err.message}, Code: http.StatusBadRequest}
+	default:
+		return models.InternalServerError
+	}
+}
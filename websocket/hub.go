@@ -1,95 +1,452 @@
 package websocket
 
 import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/mazanax/go-chat/app/db"
 	"github.com/mazanax/go-chat/app/logger"
+	"github.com/mazanax/go-chat/app/mentions"
 	"github.com/mazanax/go-chat/app/models"
+	"github.com/mazanax/go-chat/app/security"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+var HubNotRunning = fmt.Errorf("hub is not running")
+
+// Notifier is told about every stored chat message and every direct message, e.g. to email the users who are
+// offline.
+type Notifier interface {
+	MessageStored(message models.Message)
+	DirectMessageSent(message models.Message, recipientID string)
+}
+
+// Notifiers tells every one of them about stored and direct messages.
+type Notifiers []Notifier
+
+func (n Notifiers) MessageStored(message models.Message) {
+	for _, notifier := range n {
+		notifier.MessageStored(message)
+	}
+}
+
+func (n Notifiers) DirectMessageSent(message models.Message, recipientID string) {
+	for _, notifier := range n {
+		notifier.DirectMessageSent(message, recipientID)
+	}
+}
+
+type Config struct {
+	// origins allowed to open a websocket connection
+	AllowedOrigins []string
+	// proxies whose X-Forwarded-For header tells the address of a client, see CommandCall.IP
+	TrustedProxies security.TrustedProxies
+	// whether clients may negotiate permessage-deflate
+	Compression bool
+	// largest frame accepted from a client in bytes, after inflating
+	MaxFrameSize int
+	// longest text of a message in characters
+	MaxTextLength int
+	// number of the newest events kept for clients which resume their session
+	ReplaySize int
+	// what happens to a client whose send buffer is full: BackpressureDisconnect, BackpressureDropOldest or
+	// BackpressureCoalesce
+	Backpressure string
+	// a client whose send buffer stays full this long is disconnected whatever the policy
+	MaxLag time.Duration
+}
+
 type Hub struct {
-	ticketRepository  db.TicketRepository
-	onlineRepository  db.OnlineRepository
-	messageRepository db.MessageRepository
+	upgrader       websocket.Upgrader
+	trustedProxies security.TrustedProxies
+
+	ticketRepository      db.TicketRepository
+	accessTokenRepository db.AccessTokenRepository
+	userRepository        db.UserRepository
+	onlineRepository      db.OnlineRepository
+	messageRepository     db.MessageRepository
+	uploadRepository      db.UploadRepository
+	eventRepository       db.EventRepository
+	notifier              Notifier
+	maxFrameSize          int
+	maxTextLength         int
+	replaySize            int
+	backpressure          string
+	maxLag                time.Duration
 
-	// this channel is used to send notifications from the REST API
+	// this channel is used to send notifications from the REST API and the workers
 	notifications chan *models.Message
 
-	clients    map[*Client]bool
-	broadcast  chan *models.Message
+	clients map[*Client]bool
+	// number of clients of every online user, transient clients are not counted
+	connections map[string]int
+	// presence changes to publish once the current event is delivered to everybody, see announce
+	pending   []*models.Message
+	broadcast chan *models.Message
+	// stored messages with mentions, the mentioned users get a UserMentioned notification
+	mentions   chan *models.Message
 	register   chan *Client
 	unregister chan *Client
+	// direct messages sent with /msg, delivered to the sender and the recipient
+	directMessages chan directMessage
+	// command replies, delivered only to the client which ran the command
+	commandReplies chan commandReply
+	commands       map[string]Command
+
+	// liveness probes, Run closes every received channel
+	ping chan chan struct{}
 }
 
 func NewHub(
+	config Config,
 	ticketRepository db.TicketRepository,
+	accessTokenRepository db.AccessTokenRepository,
+	userRepository db.UserRepository,
 	onlineRepository db.OnlineRepository,
 	messageRepository db.MessageRepository,
+	uploadRepository db.UploadRepository,
+	eventRepository db.EventRepository,
+	notifier Notifier,
 	notifications chan *models.Message,
 ) *Hub {
-	return &Hub{
-		ticketRepository:  ticketRepository,
-		onlineRepository:  onlineRepository,
-		messageRepository: messageRepository,
+	hub := &Hub{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				for _, origin := range config.AllowedOrigins {
+					if origin == r.Header.Get("origin") {
+						return true
+					}
+				}
+
+				return false
+			},
+			// the server prefers the first one the client offers
+			Subprotocols:      []string{SubprotocolV1MessagePack, SubprotocolV1},
+			EnableCompression: config.Compression,
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+		},
+		trustedProxies: config.TrustedProxies,
+
+		ticketRepository:      ticketRepository,
+		accessTokenRepository: accessTokenRepository,
+		userRepository:        userRepository,
+		onlineRepository:      onlineRepository,
+		messageRepository:     messageRepository,
+		uploadRepository:      uploadRepository,
+		eventRepository:       eventRepository,
+		notifier:              notifier,
+		maxFrameSize:          config.MaxFrameSize,
+		maxTextLength:         config.MaxTextLength,
+		replaySize:            config.ReplaySize,
+		backpressure:          config.Backpressure,
+		maxLag:                config.MaxLag,
 
 		notifications: notifications,
 
-		broadcast:  make(chan *models.Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		broadcast:      make(chan *models.Message),
+		mentions:       make(chan *models.Message),
+		register:       make(chan *Client),
+		unregister:     make(chan *Client),
+		clients:        make(map[*Client]bool),
+		connections:    make(map[string]int),
+		directMessages: make(chan directMessage),
+		commandReplies: make(chan commandReply),
+		commands:       make(map[string]Command),
+		ping:           make(chan chan struct{}),
+	}
+	hub.registerBuiltinCommands()
+
+	return hub
+}
+
+// Ping checks that the Run loop is alive and not stuck.
+func (h *Hub) Ping(timeout time.Duration) error {
+	reply := make(chan struct{})
+	select {
+	case h.ping <- reply:
+	case <-time.After(timeout):
+		return HubNotRunning
+	}
+
+	select {
+	case <-reply:
+		return nil
+	case <-time.After(timeout):
+		return HubNotRunning
 	}
 }
 
 func (h *Hub) Run() {
 	for {
 		select {
+		case reply := <-h.ping:
+			close(reply)
 		case notification := <-h.notifications:
 			logger.Debug("[websocket] Received new notification: %v\n", notification)
-			for client := range h.clients {
-				select {
-				case client.send <- notification:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-
-					err := h.onlineRepository.RemoveUserOnline(client.userID)
-					if err != nil {
-						logger.Fatal("[websocket] Cannot remove online user: %v\n", err)
-					}
-				}
-			}
+			messagesBroadcast.WithLabelValues("notification").Inc()
+			h.publish(notification, nil)
+			h.updateGauges()
 		case client := <-h.register:
 			logger.Debug("[websocket] User connected\n")
-			err := h.onlineRepository.CreateUserOnline(client.userID)
-			if err != nil {
-				logger.Fatal("[websocket] Cannot save online user: %v\n", err)
-			}
-
 			h.clients[client] = true
+			if client.resume {
+				h.replay(client)
+			}
+			if !client.transient {
+				h.connect(client.userID)
+			}
+			h.updateGauges()
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-
-				err := h.onlineRepository.RemoveUserOnline(client.userID)
-				if err != nil {
-					logger.Fatal("[websocket] Cannot remove online user: %v\n", err)
-				}
+				h.remove(client)
+				h.updateGauges()
 			}
+		case reply := <-h.commandReplies:
+			// replies are not events, they are neither numbered nor replayed
+			if h.clients[reply.client] {
+				h.send(reply.client, reply.message)
+			}
+		case direct := <-h.directMessages:
+			messagesBroadcast.WithLabelValues("direct").Inc()
+			h.publish(direct.message, []string{direct.message.UserID, direct.recipientID})
+			h.updateGauges()
 		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-
-					err := h.onlineRepository.RemoveUserOnline(client.userID)
-					if err != nil {
-						logger.Fatal("[websocket] Cannot remove online user: %v\n", err)
-					}
+			messagesBroadcast.WithLabelValues("chat").Inc()
+			h.publish(message, nil)
+			h.updateGauges()
+		case message := <-h.mentions:
+			recipients := make([]string, 0, len(message.Mentions))
+			for _, userID := range message.Mentions {
+				if userID != message.UserID {
+					recipients = append(recipients, userID)
 				}
 			}
+			if len(recipients) == 0 {
+				continue
+			}
+
+			messagesBroadcast.WithLabelValues("mention").Inc()
+			h.publish(mentionNotification(message), recipients)
+			h.updateGauges()
 		}
+
+		h.announce()
+	}
+}
+
+// connect counts a new connection of the user, the first one makes the user online.
+func (h *Hub) connect(userID string) {
+	h.connections[userID]++
+	if h.connections[userID] > 1 {
+		return
+	}
+
+	if err := h.onlineRepository.CreateUserOnline(userID); err != nil {
+		logger.Fatal("[websocket] Cannot save online user: %v\n", err)
+	}
+	h.pending = append(h.pending, presenceNotification(userID, models.UserConnected))
+}
+
+// remove unregisters the client, the user goes offline with the last connection.
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+	close(client.send)
+	if client.transient {
+		return
+	}
+
+	h.connections[client.userID]--
+	if h.connections[client.userID] > 0 {
+		return
+	}
+
+	delete(h.connections, client.userID)
+	if err := h.onlineRepository.RemoveUserOnline(client.userID); err != nil {
+		logger.Fatal("[websocket] Cannot remove online user: %v\n", err)
+	}
+	h.pending = append(h.pending, presenceNotification(client.userID, models.UserDisconnected))
+}
+
+// announce publishes the presence changes of the last iteration of Run. They are not published right away,
+// because a client dropped while an event is delivered would get the next event before the others get the
+// current one.
+func (h *Hub) announce() {
+	for len(h.pending) > 0 {
+		notification := h.pending[0]
+		h.pending = h.pending[1:]
+
+		messagesBroadcast.WithLabelValues("presence").Inc()
+		h.publish(notification, nil)
+		h.updateGauges()
+	}
+}
+
+// publish numbers the event, buffers it for replays and sends it to the clients of the recipients, or to every
+// client if there are no recipients.
+func (h *Hub) publish(message *models.Message, recipients []string) {
+	event := models.HubEvent{Recipients: recipients, Message: *message}
+	seq, err := h.eventRepository.AppendEvent(event, h.replaySize)
+	if err != nil {
+		// the event is still delivered live, but it cannot be replayed
+		logger.Error("[websocket] Cannot buffer event %s: %v\n", message.ID, err)
+	}
+	event.Seq = seq
+	event.Message.Seq = seq
+
+	for client := range h.clients {
+		if isRecipient(event, client.userID) {
+			h.send(client, &event.Message)
+		}
+	}
+}
+
+// replay sends the events missed by a resuming client. It runs in the same iteration of Run which registers
+// the client, so the replayed events come before the live ones and none of them is lost or sent twice.
+func (h *Hub) replay(client *Client) {
+	events, complete, err := h.eventRepository.GetEventsSince(client.resumeFrom, h.replaySize)
+	if err != nil {
+		logger.Error("[websocket] Cannot read events since %d: %v\n", client.resumeFrom, err)
+		complete = false
+	}
+	if !complete {
+		resumedSessions.WithLabelValues("resync").Inc()
+		h.send(client, &models.Message{
+			ID:        uuid.NewString(),
+			UserID:    client.userID,
+			Type:      models.ResyncRequired,
+			CreatedAt: int(time.Now().Unix()),
+		})
+		return
+	}
+
+	resumedSessions.WithLabelValues("replayed").Inc()
+	for i := range events {
+		if !h.clients[client] {
+			// dropped by send
+			return
+		}
+		if isRecipient(events[i], client.userID) {
+			h.send(client, &events[i].Message)
+		}
+	}
+}
+
+func isRecipient(event models.HubEvent, userID string) bool {
+	if len(event.Recipients) == 0 {
+		return true
+	}
+	for _, recipient := range event.Recipients {
+		if recipient == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// submit stores the message of the user with the type and broadcasts it. The ID chosen by the client makes
+// retries safe: a message which was stored already is returned as is and not broadcast again.
+func (h *Hub) submit(userID string, messageType int, msg models.WebsocketMessage) (models.Message, *protocolError) {
+	messageID, parseErr := uuid.Parse(msg.ID)
+	if parseErr != nil {
+		return models.Message{}, &protocolError{ErrorInvalidID, "id must be a UUID"}
+	}
+
+	attachments, err := h.checkAttachments(userID, msg.Attachments)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	text, err := normalizeText(msg.Text, h.maxTextLength)
+	if err != nil {
+		return models.Message{}, err
+	}
+	// a message with attachments may have no text
+	if len(attachments) == 0 && len(text) == 0 {
+		return models.Message{}, &protocolError{ErrorEmptyMessage, "message has neither text nor attachments"}
+	}
+
+	mentionedIDs := mentions.Resolve(text, h.userRepository)
+	storedID, storeErr := h.messageRepository.StoreMessage(
+		userID,
+		messageType,
+		messageID.String(),
+		text,
+		mentionedIDs,
+		attachments,
+	)
+	duplicate := errors.Is(storeErr, db.MessageAlreadyStored)
+	switch {
+	case duplicate:
+		duplicateMessages.Inc()
+	case errors.Is(storeErr, db.MessageIDTaken):
+		return models.Message{}, &protocolError{ErrorIDConflict, "id belongs to a message of another user"}
+	case storeErr != nil:
+		logger.Error("[websocket] Cannot save message from %s: %s\n", userID, storeErr)
+		return models.Message{}, &protocolError{ErrorInternal, "message was not stored"}
+	}
+	messageModel, storeErr := h.messageRepository.GetMessage(storedID)
+	if storeErr != nil {
+		logger.Error("[websocket] Cannot get message #%s from %s: %s\n", storedID, userID, storeErr)
+		return models.Message{}, &protocolError{ErrorInternal, "message was not stored"}
+	}
+	if duplicate {
+		return messageModel, nil
+	}
+
+	h.broadcast <- &messageModel
+	if len(messageModel.Mentions) > 0 {
+		h.mentions <- &messageModel
+	}
+	h.notifier.MessageStored(messageModel)
+
+	return messageModel, nil
+}
+
+// checkAttachments accepts only uploads of the sender, so that nobody can share files of others by their IDs.
+func (h *Hub) checkAttachments(userID string, uploadIDs []string) ([]string, *protocolError) {
+	if len(uploadIDs) > maxAttachments {
+		return nil, &protocolError{ErrorInvalidAttachment, fmt.Sprintf("at most %d attachments are allowed", maxAttachments)}
+	}
+
+	seen := make(map[string]bool)
+	attachments := make([]string, 0, len(uploadIDs))
+	for _, uploadID := range uploadIDs {
+		if seen[uploadID] {
+			continue
+		}
+		seen[uploadID] = true
+
+		upload, err := h.uploadRepository.GetUpload(uploadID)
+		if err != nil || upload.UserID != userID {
+			return nil, &protocolError{ErrorInvalidAttachment, "unknown upload " + strconv.Quote(uploadID)}
+		}
+		attachments = append(attachments, upload.ID)
+	}
+
+	return attachments, nil
+}
+
+func mentionNotification(message *models.Message) *models.Message {
+	return &models.Message{
+		ID:        uuid.NewString(),
+		UserID:    message.UserID,
+		Type:      models.UserMentioned,
+		CreatedAt: message.CreatedAt,
+		Data:      map[string]string{"message_id": message.ID},
+	}
+}
+
+func presenceNotification(userID string, messageType int) *models.Message {
+	return &models.Message{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		CreatedAt: int(time.Now().Unix()),
+		Type:      messageType,
 	}
 }
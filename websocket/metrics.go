@@ -0,0 +1,47 @@
+package websocket
+
+import "github.com/mazanax/go-chat/app/metrics"
+
+var (
+	connectedClients = metrics.NewGauge(
+		"chat_websocket_clients",
+		"Websocket connections currently registered in the hub.",
+	)
+	onlineUsers = metrics.NewGauge(
+		"chat_online_users",
+		"Distinct users with at least one websocket connection.",
+	)
+	messagesBroadcast = metrics.NewCounterVec(
+		"chat_messages_broadcast_total",
+		"Messages fanned out by the hub, by source.",
+		"source",
+	)
+	resumedSessions = metrics.NewCounterVec(
+		"chat_websocket_resumed_sessions_total",
+		"Reconnected clients which asked for the missed events, by whether they were replayed or had to resync.",
+		"result",
+	)
+	duplicateMessages = metrics.NewCounter(
+		"chat_websocket_duplicate_messages_total",
+		"Retried submissions of messages which were stored already.",
+	)
+	droppedClients = metrics.NewCounter(
+		"chat_websocket_dropped_slow_clients_total",
+		"Clients disconnected because their send buffer was full, see Config.Backpressure.",
+	)
+	droppedEvents = metrics.NewCounterVec(
+		"chat_websocket_dropped_events_total",
+		"Events not delivered to slow clients, by whether they were dropped or merged into a later one.",
+		"reason",
+	)
+	commandsRun = metrics.NewCounterVec(
+		"chat_websocket_commands_total",
+		"Slash commands sent by clients, by command and result.",
+		"command", "result",
+	)
+)
+
+func (h *Hub) updateGauges() {
+	connectedClients.Set(float64(len(h.clients)))
+	onlineUsers.Set(float64(len(h.connections)))
+}
@@ -0,0 +1,91 @@
+package websocket
+
+import "encoding/json"
+
+// SubprotocolV1 is requested by clients in the Sec-WebSocket-Protocol header, see docs/websocket-protocol.md.
+// A client which asks for no subprotocol gets the legacy protocol: bare WebsocketMessage frames in,
+// newline-separated JsonMessage frames out and no replies.
+const SubprotocolV1 = "mznx-chat.v1"
+
+// SubprotocolV1MessagePack is protocol v1 with every frame encoded as MessagePack in a binary message instead
+// of JSON text.
+const SubprotocolV1MessagePack = "mznx-chat.v1.msgpack"
+
+const (
+	protocolLegacy = iota
+	protocolV1
+)
+
+const (
+	encodingJSON = iota
+	encodingMessagePack
+)
+
+// Operations of protocol v1.
+const (
+	// client: store and broadcast a message
+	OpSend = "send"
+	// server: the message of the frame with the same ref was stored
+	OpAck = "ack"
+	// server: the frame with the same ref was rejected
+	OpError = "error"
+	// server: a chat message or a notification from the hub
+	OpEvent = "event"
+)
+
+// Error codes of protocol v1.
+const (
+	ErrorBadFrame          = "bad_frame"
+	ErrorUnknownOp         = "unknown_op"
+	ErrorInvalidID         = "invalid_id"
+	ErrorIDConflict        = "id_conflict"
+	ErrorFrameTooLarge     = "frame_too_large"
+	ErrorEmptyMessage      = "empty_message"
+	ErrorTextTooLong       = "text_too_long"
+	ErrorInvalidText       = "invalid_text"
+	ErrorInvalidAttachment = "invalid_attachment"
+	ErrorInternal          = "internal"
+	// commands, see commands.go
+	ErrorUnknownCommand     = "unknown_command"
+	ErrorCommandUnavailable = "command_unavailable"
+	ErrorForbidden          = "forbidden"
+	ErrorInvalidArguments   = "invalid_arguments"
+	ErrorCommandFailed      = "command_failed"
+)
+
+type inboundFrame struct {
+	Op string `json:"op"`
+	// correlation ID chosen by the client, repeated in the reply
+	Ref  string          `json:"ref"`
+	Data json.RawMessage `json:"data"`
+}
+
+type outboundFrame struct {
+	Op   string      `json:"op"`
+	Ref  string      `json:"ref,omitempty"`
+	Data interface{} `json:"data"`
+}
+
+type errorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// protocolError rejects an inbound frame. Clients of protocol v1 receive it as an error frame, for legacy
+// clients it is only logged.
+type protocolError struct {
+	code    string
+	message string
+}
+
+func (e *protocolError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func errorFrame(ref string, err *protocolError) outboundFrame {
+	return outboundFrame{
+		Op:   OpError,
+		Ref:  ref,
+		Data: errorData{Code: err.code, Message: err.message},
+	}
+}
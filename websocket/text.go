@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// invisible characters which do not make a message any less blank
+var zeroWidth = map[rune]bool{
+	'\u200b': true, // zero width space
+	'\u200c': true, // zero width non-joiner
+	'\u200d': true, // zero width joiner
+	'\u2060': true, // word joiner
+	'\ufeff': true, // byte order mark
+}
+
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// normalizeText returns the text the way it is stored: composed to NFC, so that texts which look the same are
+// stored and counted the same, line breaks become \n and the blank characters around the text are removed.
+// Invalid UTF-8, control characters other than \n and \t, and texts longer than
+// maxLength runes are rejected. The returned text is empty if there was nothing but blank characters.
+func normalizeText(text string, maxLength int) (string, *protocolError) {
+	if !utf8.ValidString(text) {
+		return "", &protocolError{ErrorInvalidText, "text is not valid UTF-8"}
+	}
+
+	text = strings.TrimFunc(lineBreaks.Replace(norm.NFC.String(text)), isBlank)
+	for _, r := range text {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return "", &protocolError{ErrorInvalidText, fmt.Sprintf("text contains control character %U", r)}
+		}
+	}
+
+	if length := utf8.RuneCountInString(text); length > maxLength {
+		return "", &protocolError{
+			ErrorTextTooLong,
+			fmt.Sprintf("text is %d characters long, at most %d are allowed", length, maxLength),
+		}
+	}
+
+	return text, nil
+}
+
+func isBlank(r rune) bool {
+	return unicode.IsSpace(r) || zeroWidth[r]
+}